@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// blockTracker 记录最近窗口内上游拦截（418）、限流（429）与 5xx 错误的次数，据此放大重试间隔、收紧并发；
+// 每次成功的上游请求抵消一条记录，过期的记录在读取时清理，错误平息后系数回落到 1
+type blockTracker struct {
+	mu     sync.Mutex
+	blocks []time.Time
+}
+
+var upstreamBlocks = &blockTracker{}
+
+func (t *blockTracker) record() {
+	if !config.AdaptiveBlocking {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blocks = append(t.blocks, time.Now())
+}
+
+// success 在上游请求成功时丢弃最早的一条记录，让系数随成功逐步回落
+func (t *blockTracker) success() {
+	if !config.AdaptiveBlocking {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.blocks) > 0 {
+		t.blocks = t.blocks[1:]
+	}
+}
+
+// adaptiveStatus 判断上游状态码是否计入退让系数
+func adaptiveStatus(status int) bool {
+	return status == http.StatusTeapot || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// factor 返回当前的退让系数：窗口内每条记录加 1，上限为 ADAPTIVE_MAX_FACTOR
+func (t *blockTracker) factor() int {
+	if !config.AdaptiveBlocking {
+		return 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-config.AdaptiveWindow)
+	i := 0
+	for i < len(t.blocks) && t.blocks[i].Before(cutoff) {
+		i++
+	}
+	t.blocks = t.blocks[i:]
+
+	return min(1+len(t.blocks), max(config.AdaptiveMaxFactor, 1))
+}
+
+// adaptiveDelay 按退让系数放大重试间隔
+func adaptiveDelay(delay time.Duration) time.Duration {
+	return delay * time.Duration(upstreamBlocks.factor())
+}
+
+// adaptiveConcurrency 按退让系数缩小并发上限，最少保留 1 个
+func adaptiveConcurrency(limit int) int {
+	return max(limit/upstreamBlocks.factor(), 1)
+}
+
+// modelBlockTracker 按上游模型记录最近窗口内的 418 次数，用于 AUTO_ROUTE_HEALTHY 避开被频繁拦截的模型
+type modelBlockTracker struct {
+	mu     sync.Mutex
+	blocks map[string][]time.Time
+}
+
+var modelBlocks = &modelBlockTracker{blocks: make(map[string][]time.Time)}
+
+// record 记录一次 418；未开启 AUTO_ROUTE_HEALTHY 时不记录，记录时顺带清理窗口外的旧数据，避免无限增长
+func (t *modelBlockTracker) record(model string) {
+	if !config.AutoRouteHealthy || config.UnhealthyThreshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.blocks[model] = append(t.prune(model), time.Now())
+}
+
+// unhealthy 判断模型在 UNHEALTHY_WINDOW 内的 418 次数是否达到 UNHEALTHY_THRESHOLD
+func (t *modelBlockTracker) unhealthy(model string) bool {
+	if config.UnhealthyThreshold <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.prune(model)) >= config.UnhealthyThreshold
+}
+
+// prune 丢弃 UNHEALTHY_WINDOW 之外的记录并返回剩余部分，调用方需持有锁
+func (t *modelBlockTracker) prune(model string) []time.Time {
+	blocks := t.blocks[model]
+	cutoff := time.Now().Add(-config.UnhealthyWindow)
+	i := 0
+	for i < len(blocks) && blocks[i].Before(cutoff) {
+		i++
+	}
+	if i == len(blocks) {
+		delete(t.blocks, model)
+		return nil
+	}
+	t.blocks[model] = blocks[i:]
+	return blocks[i:]
+}
+
+// healthyAlternative 在 FALLBACK_MODELS 中按顺序选出第一个当前健康的上游模型，没有时返回空字符串
+func healthyAlternative(model string) string {
+	for _, id := range config.FallbackModels {
+		if candidate := convertModel(id); candidate != model && !modelBlocks.unhealthy(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
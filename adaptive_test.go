@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveDelay(t *testing.T) {
+	const base = 100 * time.Millisecond
+	tests := []struct {
+		name    string
+		enabled bool
+		// events 中 0 表示一次成功的上游请求，其余为上游错误的状态码
+		events []int
+		want   time.Duration
+	}{
+		{"未开启时不放大", false, []int{418, 429, 500}, base},
+		{"默认无错误", true, nil, base},
+		{"418 放大", true, []int{418}, 2 * base},
+		{"429 与 5xx 放大", true, []int{429, 502, 503}, 4 * base},
+		{"不超过上限", true, []int{418, 418, 418, 418, 418, 418}, 4 * base},
+		{"成功后回落", true, []int{418, 429, 0}, 2 * base},
+		{"持续成功回落到 1", true, []int{418, 429, 0, 0, 0}, base},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AdaptiveBlocking = tt.enabled
+				c.AdaptiveWindow = time.Minute
+				c.AdaptiveMaxFactor = 4
+			})
+			tracker := &blockTracker{}
+			for _, status := range tt.events {
+				if status == 0 {
+					tracker.success()
+				} else if adaptiveStatus(status) {
+					tracker.record()
+				}
+			}
+			if got := base * time.Duration(tracker.factor()); got != tt.want {
+				t.Errorf("delay = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveDelayWindow(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.AdaptiveBlocking = true
+		c.AdaptiveWindow = time.Minute
+		c.AdaptiveMaxFactor = 8
+	})
+	tracker := &blockTracker{blocks: []time.Time{time.Now().Add(-2 * time.Minute), time.Now()}}
+	if got := tracker.factor(); got != 2 {
+		t.Errorf("factor() = %d, want 2", got)
+	}
+}
+
+func TestSendChatRequestAdaptive(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.AdaptiveBlocking = true
+		c.AdaptiveWindow = time.Minute
+		c.AdaptiveMaxFactor = 8
+	})
+	saved := upstreamBlocks
+	upstreamBlocks = &blockTracker{}
+	t.Cleanup(func() { upstreamBlocks = saved })
+	withUpstream(t, &scriptedUpstream{chat: []int{http.StatusTooManyRequests, http.StatusInternalServerError}})
+
+	send := func() {
+		resp, err := sendChatRequest(context.Background(), []byte(`{}`), chatOptions{})
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	for _, want := range []int{2, 3, 2} {
+		send()
+		if got := upstreamBlocks.factor(); got != want {
+			t.Fatalf("factor() = %d, want %d", got, want)
+		}
+	}
+	if got := adaptiveDelay(time.Second); got != 2*time.Second {
+		t.Errorf("adaptiveDelay(1s) = %v, want 2s", got)
+	}
+}
+
+func TestModelBlockTracker(t *testing.T) {
+	tests := []struct {
+		name          string
+		autoRoute     bool
+		window        time.Duration
+		records       int
+		wantEntries   int
+		wantUnhealthy bool
+	}{
+		{"未开启 AUTO_ROUTE_HEALTHY 时不记录", false, time.Minute, 5, 0, false},
+		{"达到阈值", true, time.Minute, 2, 2, true},
+		{"未达到阈值", true, time.Minute, 1, 1, false},
+		{"窗口外的记录被清理", true, -time.Second, 5, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AutoRouteHealthy = tt.autoRoute
+				c.UnhealthyThreshold = 2
+				c.UnhealthyWindow = tt.window
+			})
+			tracker := &modelBlockTracker{blocks: make(map[string][]time.Time)}
+			for i := 0; i < tt.records; i++ {
+				tracker.record("gpt-4o-mini")
+			}
+			if got := len(tracker.blocks["gpt-4o-mini"]); got != tt.wantEntries {
+				t.Errorf("记录数 = %d, want %d", got, tt.wantEntries)
+			}
+			if got := tracker.unhealthy("gpt-4o-mini"); got != tt.wantUnhealthy {
+				t.Errorf("unhealthy() = %v, want %v", got, tt.wantUnhealthy)
+			}
+		})
+	}
+}
+
+func TestAutoRouteHealthy(t *testing.T) {
+	tests := []struct {
+		name      string
+		autoRoute bool
+		want      string
+	}{
+		{"默认不改变模型", false, "gpt-4o-mini"},
+		{"AUTO_ROUTE_HEALTHY 避开被频繁拦截的模型", true, "claude-3-haiku-20240307"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AutoRouteHealthy = tt.autoRoute
+				c.UnhealthyThreshold = 2
+				c.UnhealthyWindow = time.Minute
+				c.FallbackModels = []string{"claude-3-haiku"}
+				c.ResponseCacheTTL = 0
+			})
+			saved := modelBlocks
+			modelBlocks = &modelBlockTracker{blocks: make(map[string][]time.Time)}
+			t.Cleanup(func() { modelBlocks = saved })
+			modelBlocks.record("gpt-4o-mini")
+			modelBlocks.record("gpt-4o-mini")
+
+			withUpstream(t, &modelUpstream{})
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Upstream-Model"); got != tt.want {
+				t.Errorf("X-Upstream-Model = %q, want %q", got, tt.want)
+			}
+			var resp struct {
+				Model   string `json:"model"`
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 {
+				t.Fatalf("无效的响应: %s", w.Body.String())
+			}
+			if resp.Model != tt.want || resp.Choices[0].Message.Content != tt.want {
+				t.Errorf("model = %q, content = %q, want %q", resp.Model, resp.Choices[0].Message.Content, tt.want)
+			}
+		})
+	}
+}
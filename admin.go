@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuthMiddleware 校验 ADMIN_TOKEN，未配置时拒绝所有管理请求
+func adminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.AdminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "未配置 ADMIN_TOKEN, 管理接口已禁用"})
+			return
+		}
+		token, ok := bearerToken(c.GetHeader("Authorization"))
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "ADMIN_TOKEN无效"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleModelsHealth 并发向每个模型发送一次探测请求，报告当前可用情况
+func handleModelsHealth(c *gin.Context) {
+	results := make([]gin.H, len(modelCatalog))
+	concurrency := config.HealthProbeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, info := range modelCatalog {
+		wg.Add(1)
+		go func(i int, info ModelInfo) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := gin.H{"id": info.ID, "upstream": info.Upstream, "status": "ok", "upstream_status": http.StatusOK}
+			if err := probeModel(c.Request.Context(), info.Upstream); err != nil {
+				result["status"] = "failed"
+				result["error"] = err.Error()
+				result["upstream_status"] = 0
+				var upstreamErr *UpstreamError
+				if errors.As(err, &upstreamErr) {
+					result["upstream_status"] = upstreamErr.StatusCode
+					if upstreamErr.StatusCode == http.StatusTeapot {
+						modelBlocks.record(info.Upstream)
+					}
+				}
+			}
+			results[i] = result
+		}(i, info)
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": results})
+}
+
+func probeModel(ctx context.Context, upstreamModel string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": upstreamModel,
+		"messages": []map[string]interface{}{
+			{"role": "user", "content": "hi"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := sendChatRequest(ctx, body, chatOptions{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// handleReload 重新加载 APIKEYS_FILE，用于不重启轮换 key
+func handleReload(c *gin.Context) {
+	if config.APIKeysFile == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未配置 APIKEYS_FILE"})
+		return
+	}
+	if err := apiKeys.load(config.APIKeysFile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("加载 API key 文件失败: %v", err)})
+		return
+	}
+	log.Printf("已重新加载 API key: %d 个", apiKeys.size())
+	c.JSON(http.StatusOK, gin.H{"api_keys": apiKeys.size()})
+}
+
+// handleCacheFlush 清空 token 缓存与响应缓存，用于上游 token 失效时快速恢复
+func handleCacheFlush(c *gin.Context) {
+	tokens := tokenCache.flush()
+	responses := responseCache.flush()
+	log.Printf("已清空缓存: token %d 条, 响应 %d 条", tokens, responses)
+	c.JSON(http.StatusOK, gin.H{"tokens_cleared": tokens, "responses_cleared": responses})
+}
+
+// handleConfig 返回当前生效的配置，时长以可读形式输出，密钥与代理凭据被遮盖
+func handleConfig(c *gin.Context) {
+	effective := make(map[string]interface{})
+	value := reflect.ValueOf(config)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		switch field := value.Field(i).Interface().(type) {
+		case time.Duration:
+			effective[name] = field.String()
+		case []*net.IPNet:
+			nets := make([]string, 0, len(field))
+			for _, ipNet := range field {
+				nets = append(nets, ipNet.String())
+			}
+			effective[name] = nets
+		default:
+			effective[name] = field
+		}
+	}
+
+	effective["AdminToken"] = maskConfigSecret(config.AdminToken)
+	effective["ProxyURL"] = redactProxyURL(config.ProxyURL)
+	proxies := make([]string, 0, len(config.ProxyURLs))
+	for _, proxy := range config.ProxyURLs {
+		proxies = append(proxies, redactProxyURL(proxy))
+	}
+	effective["ProxyURLs"] = proxies
+	effective["APIKey"] = maskConfigSecret(os.Getenv("APIKEY"))
+	keys := make([]string, 0, len(config.APIKeys))
+	for _, key := range config.APIKeys {
+		keys = append(keys, maskConfigSecret(key))
+	}
+	effective["APIKeys"] = keys
+	scopes := make(map[string][]string, len(config.KeyScopes))
+	for key, models := range config.KeyScopes {
+		scopes[maskConfigSecret(key)] = models
+	}
+	effective["KeyScopes"] = scopes
+	effective["APIKeysLoaded"] = apiKeys.size()
+
+	c.JSON(http.StatusOK, effective)
+}
+
+func maskConfigSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return maskSecret(value)
+}
+
+// redactProxyURL 隐藏代理地址中的密码
+func redactProxyURL(raw string) string {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return maskConfigSecret(raw)
+	}
+	return proxyURL.Redacted()
+}
+
+// ddgPassthroughHeaders 为透传接口从上游响应中复制回客户端的头
+var ddgPassthroughHeaders = []string{"Content-Type", "Content-Encoding", "x-vqd-4", "x-vqd-hash-1", "Retry-After"}
+
+// handleDDGPassthrough 将请求原样转发到 duckchat 下的同名路径，附带伪装头与当前 token，
+// 返回上游的原始状态码与响应体，用于分析上游新增的接口
+func handleDDGPassthrough(c *gin.Context) {
+	target := "https://duckduckgo.com/duckchat" + c.Param("path")
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, target, c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("创建请求失败: %v", err)})
+		return
+	}
+	for k, v := range config.FakeHeaders {
+		upstreamReq.Header.Set(k, v)
+	}
+	if contentType := c.GetHeader("Content-Type"); contentType != "" {
+		upstreamReq.Header.Set("Content-Type", contentType)
+	}
+	// 获取 token 失败时仍然转发，便于观察上游对无 token 请求的响应
+	if token, err := getToken(c.Request.Context()); err == nil {
+		upstreamReq.Header.Set("x-vqd-4", token)
+	} else {
+		log.Printf("透传请求获取 token 失败, 不附带 x-vqd-4: %v", err)
+	}
+
+	resp, err := createHTTPClient(30 * time.Second).Do(upstreamReq)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": newNetworkError(err).Error()})
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range ddgPassthroughHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			c.Header(name, value)
+		}
+	}
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyContextKey 保存通过校验的客户端 API key，供后续中间件使用
+const apiKeyContextKey = "apiKey"
+
+// keyRing 保存从 APIKEYS_FILE 加载的 key，重新加载时整体替换
+type keyRing struct {
+	mu   sync.RWMutex
+	keys map[string]struct{}
+}
+
+var apiKeys = &keyRing{}
+
+// load 读取 key 文件，每行一个 key，忽略空行与 # 开头的注释
+func (r *keyRing) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *keyRing) size() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+func (r *keyRing) contains(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.keys[key]
+	return ok
+}
+
+// authEnabled 任一 key 来源非空时启用鉴权
+func authEnabled() bool {
+	return os.Getenv("APIKEY") != "" || len(config.APIKeys) > 0 || apiKeys.size() > 0
+}
+
+// validAPIKey 校验 key 是否属于 APIKEY、APIKEYS 与 key 文件的并集
+func validAPIKey(key string) bool {
+	if apiKey := os.Getenv("APIKEY"); apiKey != "" && key == apiKey {
+		return true
+	}
+	for _, k := range config.APIKeys {
+		if key == k {
+			return true
+		}
+	}
+	return apiKeys.contains(key)
+}
+
+// bearerToken 从 Authorization 头中取出 token：scheme 不区分大小写，
+// 并兼容网关重复添加前缀得到的 "Bearer Bearer <key>"
+func bearerToken(header string) (string, bool) {
+	token := strings.TrimSpace(header)
+	found := false
+	for {
+		scheme, rest, ok := strings.Cut(token, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			break
+		}
+		token = strings.TrimSpace(rest)
+		found = true
+	}
+	return token, found && token != ""
+}
+
+func apiKeyAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authorizationHeader := c.GetHeader("Authorization")
+
+		// 要求鉴权却没有任何可用 key 时失败关闭，而不是退化为开放模式
+		if config.RequireAuth && !authEnabled() {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "服务要求鉴权但未配置 APIKEY"})
+			return
+		}
+
+		// 无法设置请求头的客户端可通过 ?api_key= 传入，需显式开启；访问日志与调试日志中的 key 会被遮盖
+		if authorizationHeader == "" && config.AllowQueryAPIKey {
+			if key := c.Query("api_key"); key != "" {
+				authorizationHeader = "Bearer " + key
+			}
+		}
+
+		if authEnabled() {
+			providedToken, isBearer := bearerToken(authorizationHeader)
+			if authorizationHeader == "" {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未提供 APIKEY"})
+				return
+			} else if !isBearer {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "APIKEY 格式错误"})
+				return
+			} else if !validAPIKey(providedToken) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "APIKEY无效"})
+				return
+			}
+			c.Set(apiKeyContextKey, providedToken)
+		}
+		c.Next()
+	}
+}
+
+// clientKey 返回用于限流统计的客户端标识：优先使用 API key，未启用鉴权时退化为客户端 IP
+func clientKey(c *gin.Context) string {
+	if key := c.GetString(apiKeyContextKey); key != "" {
+		return "key:" + key
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// parseKeyScopes 解析 KEY_SCOPES，格式为 {"key": ["gpt-4o-mini", "claude-3-haiku"]}，"*" 表示全部模型
+func parseKeyScopes(raw string) map[string][]string {
+	if raw == "" {
+		return nil
+	}
+	var scopes map[string][]string
+	if err := json.Unmarshal([]byte(raw), &scopes); err != nil {
+		log.Printf("KEY_SCOPES 解析失败, 已忽略: %v", err)
+		return nil
+	}
+	return scopes
+}
+
+// keyAllowsModel 判断 key 能否使用该上游模型；未在 KEY_SCOPES 中出现的 key 不受限制，
+// 范围中的模型名按别名与前缀规则解析后比较
+func keyAllowsModel(key, upstreamModel string) bool {
+	allowed, scoped := config.KeyScopes[key]
+	if !scoped {
+		return true
+	}
+	for _, id := range allowed {
+		if id == "*" {
+			return true
+		}
+		if info, ok := resolveModel(id); ok && info.Upstream == upstreamModel {
+			return true
+		}
+	}
+	return false
+}
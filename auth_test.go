@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withKeyRing 在测试期间使用独立的 key 文件集合
+func withKeyRing(t *testing.T) {
+	t.Helper()
+	saved := apiKeys
+	apiKeys = &keyRing{}
+	t.Cleanup(func() { apiKeys = saved })
+	t.Setenv("APIKEY", "")
+}
+
+func TestAPIKeysFile(t *testing.T) {
+	withKeyRing(t)
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	if err := os.WriteFile(path, []byte("# 注释\nkey-a\n\n  key-b  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(c *Config) {
+		c.APIKeys = nil
+		c.APIKeysFile = path
+	})
+	if err := apiKeys.load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"key-a", true},
+		{"key-b", true},
+		{"# 注释", false},
+		{"", false},
+		{"key-c", false},
+	}
+	for _, tt := range tests {
+		if got := validAPIKey(tt.key); got != tt.want {
+			t.Errorf("validAPIKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	// 轮换后通过 /admin/reload 重新加载
+	if err := os.WriteFile(path, []byte("key-c\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/admin/reload", handleReload)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reload status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if validAPIKey("key-a") || !validAPIKey("key-c") {
+		t.Error("重新加载后 key 未轮换")
+	}
+}
+
+func TestAPIKeyUnion(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiKey  string
+		apiKeys []string
+		header  string
+		want    int
+	}{
+		{"默认不鉴权", "", nil, "", http.StatusOK},
+		{"APIKEY 中的 key", "single-key", []string{"multi-a", "multi-b"}, "Bearer single-key", http.StatusOK},
+		{"APIKEYS 中的 key", "single-key", []string{"multi-a", "multi-b"}, "Bearer multi-b", http.StatusOK},
+		{"两者之外的 key", "single-key", []string{"multi-a", "multi-b"}, "Bearer other", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withKeyRing(t)
+			t.Setenv("APIKEY", tt.apiKey)
+			withConfig(t, func(c *Config) {
+				c.APIKeys = tt.apiKeys
+				c.RequireAuth = false
+			})
+			r := gin.New()
+			r.GET("/ping", apiKeyAuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		requireAuth bool
+		apiKey      string
+		header      string
+		want        int
+	}{
+		{"默认未配置 key 时开放", false, "", "", http.StatusOK},
+		{"REQUIRE_AUTH 且未配置 key 时拒绝", true, "", "Bearer anything", http.StatusUnauthorized},
+		{"REQUIRE_AUTH 且 key 正确", true, "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withKeyRing(t)
+			t.Setenv("APIKEY", tt.apiKey)
+			withConfig(t, func(c *Config) {
+				c.APIKeys = nil
+				c.RequireAuth = tt.requireAuth
+			})
+			r := gin.New()
+			r.GET("/ping", apiKeyAuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyScopes(t *testing.T) {
+	scopes := parseKeyScopes(`{"cheap-key": ["gpt-4o-mini"], "admin-key": ["*"]}`)
+	tests := []struct {
+		name  string
+		key   string
+		model string
+		want  int
+	}{
+		{"未列出的 key 不受限制", "other-key", "claude-3-haiku", http.StatusOK},
+		{"范围内的模型", "cheap-key", "gpt-4o-mini", http.StatusOK},
+		{"按别名解析后比较", "cheap-key", "gpt-3.5-turbo", http.StatusOK},
+		{"范围外的模型返回 403", "cheap-key", "claude-3-haiku", http.StatusForbidden},
+		{"* 允许全部模型", "admin-key", "claude-3-haiku", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withKeyRing(t)
+			withConfig(t, func(c *Config) {
+				c.APIKeys = []string{"cheap-key", "admin-key", "other-key"}
+				c.KeyScopes = scopes
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+			})
+			withUpstream(t, &scriptedUpstream{})
+			r := gin.New()
+			r.POST("/v1/chat/completions", apiKeyAuthMiddleware(), handleCompletion)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+				strings.NewReader(`{"model":"`+tt.model+`","messages":[{"role":"user","content":"hi"}]}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	if got := parseKeyScopes("not-json"); got != nil {
+		t.Errorf("parseKeyScopes(无效 JSON) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseBlockedIPs 解析 BLOCKED_IPS 中的 CIDR，单个 IP 视为 /32 或 /128，无效项记录日志后忽略
+func parseBlockedIPs(items []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("BLOCKED_IPS 中的条目无效, 已忽略: %s", item)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// blockedIPMiddleware 拒绝来自 BLOCKED_IPS 的客户端；客户端 IP 按 TRUSTED_PROXIES 解析
+func blockedIPMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(config.BlockedIPs) == 0 {
+			c.Next()
+			return
+		}
+		ip := net.ParseIP(c.ClientIP())
+		for _, ipNet := range config.BlockedIPs {
+			if ip != nil && ipNet.Contains(ip) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "访问被拒绝"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBlockedIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocked []string
+		proxies []string
+		want    int
+	}{
+		{"默认不拒绝", nil, nil, http.StatusOK},
+		{"匹配 CIDR 时返回 403", []string{"192.0.2.0/24"}, nil, http.StatusForbidden},
+		{"单个 IP", []string{"192.0.2.1"}, nil, http.StatusForbidden},
+		{"不匹配时放行", []string{"10.0.0.0/8", "not-an-ip"}, nil, http.StatusOK},
+		{"按 TRUSTED_PROXIES 解析的客户端 IP 判断", []string{"203.0.113.0/24"}, []string{"192.0.2.0/24"}, http.StatusForbidden},
+		{"未信任代理时不采用 X-Forwarded-For", []string{"203.0.113.0/24"}, nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.BlockedIPs = parseBlockedIPs(tt.blocked)
+				c.TrustedProxies = tt.proxies
+			})
+			r, err := newRouter()
+			if err != nil {
+				t.Fatalf("newRouter: %v", err)
+			}
+			r.GET("/client-ip", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/client-ip", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	content string
+	expires time.Time
+}
+
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// maxEntries 限制条目数，写入时已满则先清理过期条目，仍满时淘汰最早过期的条目；0 表示不限制
+	maxEntries int
+}
+
+var (
+	responseCache = &ttlCache{entries: make(map[string]cacheEntry)}
+	tokenCache    = &ttlCache{entries: make(map[string]cacheEntry)}
+)
+
+const tokenCacheKey = "vqd"
+
+func (tc *ttlCache) get(key string) (string, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	entry, ok := tc.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(tc.entries, key)
+		return "", false
+	}
+	return entry.content, true
+}
+
+func (tc *ttlCache) set(key, content string, ttl time.Duration) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.entries[key]; !ok && tc.maxEntries > 0 && len(tc.entries) >= tc.maxEntries {
+		tc.removeExpired(time.Now())
+		if len(tc.entries) >= tc.maxEntries {
+			tc.evictOldest()
+		}
+	}
+	tc.entries[key] = cacheEntry{content: content, expires: time.Now().Add(ttl)}
+}
+
+// sweep 清理所有已过期的条目，返回清理的数量
+func (tc *ttlCache) sweep() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.removeExpired(time.Now())
+}
+
+// removeExpired 删除 now 时已过期的条目，调用方需持有锁
+func (tc *ttlCache) removeExpired(now time.Time) int {
+	removed := 0
+	for key, entry := range tc.entries {
+		if now.After(entry.expires) {
+			delete(tc.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// evictOldest 淘汰最早过期的条目，调用方需持有锁
+func (tc *ttlCache) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range tc.entries {
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	delete(tc.entries, oldestKey)
+}
+
+// startCacheSweeper 定期清理各缓存中的过期条目，避免只写不读的键一直占用内存
+func startCacheSweeper(interval time.Duration, caches ...*ttlCache) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			for _, cache := range caches {
+				cache.sweep()
+			}
+		}
+	}()
+}
+
+// flush 清空缓存并返回清除的条目数
+func (tc *ttlCache) flush() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	n := len(tc.entries)
+	tc.entries = make(map[string]cacheEntry)
+	return n
+}
+
+// cacheKey 只根据影响输出的字段生成缓存键，user、stream 等字段不参与计算；
+// model 为实际请求的上游模型，X-DDG-Model 等改写后的请求不会命中原模型的缓存
+func cacheKey(req *ChatRequest, model string) string {
+	canonical := samplingParams(req)
+	canonical["model"] = model
+	canonical["messages"] = req.Messages
+
+	// encoding/json 会按键名排序 map，保证序列化结果稳定
+	data, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	temperature := 0.5
+	base := func() ChatRequest {
+		return ChatRequest{
+			Model:    "gpt-4o-mini",
+			Messages: []ChatMessage{{Role: "user", Content: "hi"}},
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(req *ChatRequest) string
+		same   bool
+	}{
+		{"只有 user 不同", func(req *ChatRequest) string { req.User = "alice"; return "gpt-4o-mini" }, true},
+		{"只有 stream 不同", func(req *ChatRequest) string { req.Stream = true; return "gpt-4o-mini" }, true},
+		{"请求中的 model 不同但上游模型相同", func(req *ChatRequest) string { req.Model = "gpt-4o"; return "gpt-4o-mini" }, true},
+		{"上游模型不同", func(req *ChatRequest) string { return "o3-mini" }, false},
+		{"消息不同", func(req *ChatRequest) string {
+			req.Messages = []ChatMessage{{Role: "user", Content: "hello"}}
+			return "gpt-4o-mini"
+		}, false},
+		{"采样参数不同", func(req *ChatRequest) string { req.Temperature = &temperature; return "gpt-4o-mini" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base()
+			want := cacheKey(&req, "gpt-4o-mini")
+			other := base()
+			model := tt.modify(&other)
+			if got := cacheKey(&other, model); (got == want) != tt.same {
+				t.Errorf("缓存键相同 = %v, want %v", got == want, tt.same)
+			}
+		})
+	}
+}
+
+func TestTTLCacheExpires(t *testing.T) {
+	cache := &ttlCache{entries: make(map[string]cacheEntry)}
+	cache.set("live", "a", time.Minute)
+	cache.set("expired", "b", -time.Second)
+
+	if got, ok := cache.get("live"); !ok || got != "a" {
+		t.Errorf("get(live) = %q, %v", got, ok)
+	}
+	if _, ok := cache.get("expired"); ok {
+		t.Error("过期条目仍然命中")
+	}
+	if n := cache.flush(); n != 1 {
+		t.Errorf("flush() = %d, want 1", n)
+	}
+}
+
+func TestTTLCacheMaxEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxEntries  int
+		setup       func(cache *ttlCache)
+		wantPresent []string
+		wantAbsent  []string
+	}{
+		{
+			name:       "已满时优先清理过期条目",
+			maxEntries: 2,
+			setup: func(cache *ttlCache) {
+				cache.set("expired", "a", -time.Second)
+				cache.set("live", "b", time.Minute)
+				cache.set("new", "c", time.Minute)
+			},
+			wantPresent: []string{"live", "new"},
+			wantAbsent:  []string{"expired"},
+		},
+		{
+			name:       "没有过期条目时淘汰最早过期的",
+			maxEntries: 2,
+			setup: func(cache *ttlCache) {
+				cache.set("short", "a", time.Minute)
+				cache.set("long", "b", time.Hour)
+				cache.set("new", "c", time.Hour)
+			},
+			wantPresent: []string{"long", "new"},
+			wantAbsent:  []string{"short"},
+		},
+		{
+			name:       "覆盖已有的键不淘汰",
+			maxEntries: 2,
+			setup: func(cache *ttlCache) {
+				cache.set("a", "1", time.Minute)
+				cache.set("b", "2", time.Hour)
+				cache.set("a", "3", time.Minute)
+			},
+			wantPresent: []string{"a", "b"},
+		},
+		{
+			name:       "0 表示不限制",
+			maxEntries: 0,
+			setup: func(cache *ttlCache) {
+				for _, key := range []string{"a", "b", "c"} {
+					cache.set(key, key, time.Minute)
+				}
+			},
+			wantPresent: []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &ttlCache{entries: make(map[string]cacheEntry), maxEntries: tt.maxEntries}
+			tt.setup(cache)
+			for _, key := range tt.wantPresent {
+				if _, ok := cache.get(key); !ok {
+					t.Errorf("%s 被淘汰", key)
+				}
+			}
+			for _, key := range tt.wantAbsent {
+				if _, ok := cache.entries[key]; ok {
+					t.Errorf("%s 未被淘汰", key)
+				}
+			}
+		})
+	}
+}
+
+func TestTTLCacheSweep(t *testing.T) {
+	cache := &ttlCache{entries: make(map[string]cacheEntry)}
+	cache.set("expired-1", "a", -time.Second)
+	cache.set("expired-2", "b", -time.Second)
+	cache.set("live", "c", time.Minute)
+
+	if n := cache.sweep(); n != 2 {
+		t.Errorf("sweep() = %d, want 2", n)
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("剩余 %d 条, want 1", len(cache.entries))
+	}
+
+	swept := &ttlCache{entries: make(map[string]cacheEntry)}
+	swept.set("expired", "a", -time.Second)
+	startCacheSweeper(10*time.Millisecond, swept)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		swept.mu.Lock()
+		n := len(swept.entries)
+		swept.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("后台清理未删除过期条目")
+}
+
+// modelUpstream 按请求体中的 model 返回结果：unavailable 中的模型返回 ERR_MODEL_UNAVAILABLE，其余模型回答自己的名字
+type modelUpstream struct {
+	unavailable map[string]bool
+}
+
+func (m *modelUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/duckchat/v1/status" {
+		w.Header().Set("x-vqd-4", testVQD)
+		return
+	}
+	var body struct {
+		Model string `json:"model"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if m.unavailable[body.Model] {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"ERR_MODEL_UNAVAILABLE"}`))
+		return
+	}
+	fmt.Fprintf(w, "data: {\"message\":%q}\n\ndata: [DONE]\n\n", body.Model)
+}
+
+func TestResponseCacheFallbackModel(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ResponseCacheTTL = time.Minute
+		c.FallbackModels = []string{"claude-3-haiku"}
+		c.ExposeDiagHeaders = true
+		c.RetryDelay = 0
+		c.ConversationIDs = false
+	})
+	responseCache.flush()
+	t.Cleanup(func() { responseCache.flush() })
+	upstream := &modelUpstream{unavailable: map[string]bool{"gpt-4o-mini": true}}
+	withUpstream(t, upstream)
+
+	body := `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"cache fallback"}]}`
+	steps := []struct {
+		name        string
+		unavailable bool
+		wantCache   string
+		wantContent string
+	}{
+		{"主模型不可用时由备用模型回答", true, "MISS", "claude-3-haiku-20240307"},
+		{"备用模型的回答不作为主模型的缓存", false, "MISS", "gpt-4o-mini"},
+		{"主模型自己的回答可以命中", false, "HIT", "gpt-4o-mini"},
+	}
+	for _, step := range steps {
+		upstream.unavailable["gpt-4o-mini"] = step.unavailable
+		w := postCompletion(t, handleCompletion, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body: %s", step.name, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Cache"); got != step.wantCache {
+			t.Errorf("%s: X-Cache = %q, want %q", step.name, got, step.wantCache)
+		}
+		if !strings.Contains(w.Body.String(), `"content":"`+step.wantContent+`"`) {
+			t.Errorf("%s: body = %s, want content %q", step.name, w.Body.String(), step.wantContent)
+		}
+	}
+}
+
+func TestResponseCacheHealthRouting(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ResponseCacheTTL = time.Minute
+		c.AutoRouteHealthy = true
+		c.UnhealthyThreshold = 1
+		c.UnhealthyWindow = time.Minute
+		c.FallbackModels = []string{"claude-3-haiku"}
+		c.ExposeDiagHeaders = true
+		c.ConversationIDs = false
+	})
+	responseCache.flush()
+	t.Cleanup(func() {
+		responseCache.flush()
+		modelBlocks = &modelBlockTracker{blocks: make(map[string][]time.Time)}
+	})
+	withUpstream(t, &modelUpstream{})
+
+	body := `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"cache routing"}]}`
+	req := ChatRequest{Model: "gpt-4o-mini", Messages: []ChatMessage{{Role: "user", Content: "cache routing"}}}
+	responseCache.set(cacheKey(&req, "gpt-4o-mini"), "stale gpt-4o-mini", time.Minute)
+	modelBlocks.record("gpt-4o-mini")
+
+	w := postCompletion(t, handleCompletion, body)
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS", got)
+	}
+	if got := w.Header().Get("X-Upstream-Model"); got != "claude-3-haiku-20240307" {
+		t.Errorf("X-Upstream-Model = %q", got)
+	}
+	if !strings.Contains(w.Body.String(), `"content":"claude-3-haiku-20240307"`) {
+		t.Errorf("路由后仍返回原模型的缓存: %s", w.Body.String())
+	}
+}
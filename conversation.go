@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// conversationCache 保存会话到上游最近一次返回的 x-vqd-4，下一轮对话带上它即可延续同一个上游会话；
+// 键由 API key 与会话 id 组成，一个 key 无法读取或延续其他 key 的会话
+var conversationCache = &ttlCache{entries: make(map[string]cacheEntry)}
+
+const (
+	conversationIDPrefix     = "conv-"
+	conversationIDContextKey = "conversationID"
+)
+
+// newConversationID 生成不可猜测的会话 id，会话只能由代理签发
+func newConversationID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return conversationIDPrefix + hex.EncodeToString(buf)
+}
+
+func conversationKey(apiKey, id string) string {
+	return apiKey + "\x00" + id
+}
+
+// resolveConversation 返回本次请求使用的会话 id 以及可延续的 token：
+// 客户端通过 X-Conversation-Id 传入的 id 只有是当前 API key 下仍有效的会话时才会被沿用，
+// 未知、已过期或属于其他 key 的 id 一律重新签发
+func resolveConversation(c *gin.Context) (string, string) {
+	id := strings.TrimSpace(c.GetHeader("X-Conversation-Id"))
+	if strings.HasPrefix(id, conversationIDPrefix) {
+		if vqd, ok := conversationCache.get(conversationKey(c.GetString(apiKeyContextKey), id)); ok {
+			return id, vqd
+		}
+	}
+	return newConversationID(), ""
+}
+
+// saveConversation 记录上游在对话响应中返回的新 token，供同一 key 下同一会话的下一轮使用
+func saveConversation(apiKey, id, vqd string) {
+	if id == "" || vqd == "" {
+		return
+	}
+	conversationCache.set(conversationKey(apiKey, id), vqd, config.ConversationTTL)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// conversationUpstream 在对话响应中返回新的 x-vqd-4，并记录每次对话请求带来的 token
+type conversationUpstream struct {
+	mu       sync.Mutex
+	received []string
+}
+
+func (u *conversationUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/duckchat/v1/status" {
+		w.Header().Set("x-vqd-4", testVQD)
+		return
+	}
+	u.mu.Lock()
+	u.received = append(u.received, r.Header.Get("x-vqd-4"))
+	u.mu.Unlock()
+	w.Header().Set("x-vqd-4", "4-continuedconversationtoken")
+	w.Write([]byte("data: {\"message\":\"ok\"}\n\ndata: [DONE]\n\n"))
+}
+
+func (u *conversationUpstream) last() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.received[len(u.received)-1]
+}
+
+func postConversation(t *testing.T, apiKey, conversationID string, stream bool) *httptest.ResponseRecorder {
+	t.Helper()
+	r := gin.New()
+	r.POST("/v1/chat/completions", func(c *gin.Context) { c.Set(apiKeyContextKey, apiKey) }, handleCompletion)
+	body := `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`
+	if stream {
+		body = strings.Replace(body, "{", `{"stream":true,`, 1)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if conversationID != "" {
+		req.Header.Set("X-Conversation-Id", conversationID)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestConversationIDs(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ConversationIDs = true
+		c.ConversationTTL = time.Minute
+	})
+	conversationCache.flush()
+	t.Cleanup(func() { conversationCache.flush() })
+	upstream := &conversationUpstream{}
+	withUpstream(t, upstream)
+
+	first := postConversation(t, "key-a", "", false)
+	issued := first.Header().Get("X-Conversation-Id")
+	if !strings.HasPrefix(issued, conversationIDPrefix) || len(issued) != len(conversationIDPrefix)+32 {
+		t.Fatalf("签发的会话 id = %q", issued)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(first.Body.Bytes(), &body)
+	if body["conversation_id"] != issued {
+		t.Errorf("响应体 conversation_id = %v, want %s", body["conversation_id"], issued)
+	}
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		id       string
+		wantSame bool
+		wantVQD  string
+	}{
+		{"同一 key 延续会话", "key-a", issued, true, "4-continuedconversationtoken"},
+		{"其他 key 不能延续", "key-b", issued, false, testVQD},
+		{"客户端自造的 id 不被接受", "key-a", "conv-guessed", false, testVQD},
+		{"格式不符的 id 不被接受", "key-a", "anything", false, testVQD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postConversation(t, tt.apiKey, tt.id, false)
+			if got := w.Header().Get("X-Conversation-Id"); (got == tt.id) != tt.wantSame {
+				t.Errorf("X-Conversation-Id = %q, 沿用 = %v, want %v", got, got == tt.id, tt.wantSame)
+			}
+			if got := upstream.last(); got != tt.wantVQD {
+				t.Errorf("上游收到的 token = %q, want %q", got, tt.wantVQD)
+			}
+		})
+	}
+}
+
+func TestConversationIDInStreamChunks(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ConversationIDs = true
+		c.ConversationTTL = time.Minute
+	})
+	t.Cleanup(func() { conversationCache.flush() })
+	withUpstream(t, &conversationUpstream{})
+
+	w := postConversation(t, "key-a", "", true)
+	id := w.Header().Get("X-Conversation-Id")
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "data: {") {
+			continue
+		}
+		var chunk map[string]interface{}
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk)
+		if chunk["conversation_id"] != id {
+			t.Errorf("数据块缺少 conversation_id: %s", line)
+		}
+	}
+}
+
+func TestConversationCacheBounded(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ConversationTTL = time.Minute })
+	saved := conversationCache
+	conversationCache = &ttlCache{entries: make(map[string]cacheEntry), maxEntries: 2}
+	t.Cleanup(func() { conversationCache = saved })
+
+	for _, id := range []string{"conv-1", "conv-2", "conv-3"} {
+		saveConversation("key", id, testVQD)
+	}
+	if n := len(conversationCache.entries); n != 2 {
+		t.Errorf("会话数 = %d, want 2", n)
+	}
+}
+
+func TestCORSExposesConversationID(t *testing.T) {
+	r := gin.New()
+	r.Use(corsMiddleware())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, "X-Conversation-Id") {
+		t.Errorf("Access-Control-Expose-Headers = %q", got)
+	}
+}
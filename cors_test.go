@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORSMiddlewareVary(t *testing.T) {
+	tests := []struct {
+		name            string
+		origins         []string
+		origin          string
+		wantAllow       string
+		wantVary        bool
+		wantCredentials string
+	}{
+		{"未配置来源", nil, "https://a.example", "*", false, ""},
+		{"命中配置的来源", []string{"https://a.example"}, "https://a.example", "https://a.example", true, "true"},
+		{"未命中配置的来源", []string{"https://a.example"}, "https://b.example", "*", true, ""},
+		{"没有 Origin 头", []string{"https://a.example"}, "", "*", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.CORSOrigins = tt.origins })
+			r := gin.New()
+			r.Use(corsMiddleware())
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if got := w.Header().Get("Vary") == "Origin"; got != tt.wantVary {
+				t.Errorf("Vary: Origin = %v, want %v", got, tt.wantVary)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, tt.wantCredentials)
+			}
+		})
+	}
+}
+
+func TestCORSPreflightAllowHeaders(t *testing.T) {
+	const sdkHeaders = "authorization,content-type,x-stainless-os,openai-organization"
+	tests := []struct {
+		name       string
+		configured []string
+		origins    []string
+		origin     string
+		want       string
+	}{
+		{"未配置时回显 SDK 请求的头", nil, nil, "https://app.example", sdkHeaders},
+		{"显式配置时使用配置的列表", []string{"Authorization", "Content-Type"}, nil, "https://app.example", "Authorization, Content-Type"},
+		{"携带凭据的来源使用内置列表", nil, []string{"https://app.example"}, "https://app.example", "Authorization, Content-Type, Accept, Accept-Language, X-DDG-Model, X-DDG-Timeout, X-DDG-No-SSE, X-DDG-Raw, X-DDG-Max-Retries, X-DDG-Retry-Delay-Ms, X-DDG-Stop-Regex, X-DDG-Include-Prompt, X-Request-ID, X-Conversation-Id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.CORSAllowHeaders = tt.configured
+				c.CORSOrigins = tt.origins
+			})
+			r := gin.New()
+			r.Use(corsMiddleware())
+			r.POST("/v1/chat/completions", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", sdkHeaders)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want 204", w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Headers"); got != tt.want {
+				t.Errorf("Access-Control-Allow-Headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
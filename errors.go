@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamError 描述一次失败的上游调用，保留状态码与响应内容以便决定是否重试
+type UpstreamError struct {
+	StatusCode int
+	Body       string
+	// Type 为上游返回的错误类型（如 ERR_INVALID_VQD），网络错误时为 network_error
+	Type string
+	// Step 标记失败发生在尝试中的哪一步
+	Step string
+	// RetryAfter 为上游 429 响应中 Retry-After 要求的等待时间，未提供时为 0
+	RetryAfter time.Duration
+}
+
+const (
+	stepToken = "获取 token"
+	stepChat  = "对话请求"
+)
+
+// withStep 为错误标记失败的子步骤，非 UpstreamError 原样返回
+func withStep(err error, step string) error {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		upstreamErr.Step = step
+	}
+	return err
+}
+
+func newUpstreamError(resp *http.Response) *UpstreamError {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	upstreamErr := &UpstreamError{
+		StatusCode: resp.StatusCode,
+		Body:       string(bodyBytes),
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		upstreamErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+
+	var payload struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(bodyBytes, &payload) == nil {
+		upstreamErr.Type = payload.Type
+	}
+	return upstreamErr
+}
+
+// parseRetryAfter 解析秒数或 HTTP 日期形式的 Retry-After，无法解析或已过期时返回 0
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+const (
+	errTypeNetwork    = "network_error"
+	errTypeDNS        = "dns_error"
+	errTypeTLSTimeout = "tls_handshake_timeout"
+	errTypeTLSCert    = "tls_cert_error"
+	errTypeTimeout    = "timeout"
+	errTypeInvalidVQD = "invalid_vqd"
+)
+
+// newNetworkError 对网络层错误分类：DNS 解析失败、TLS 握手超时等临时错误可以重试，
+// 证书校验失败属于永久错误，重试没有意义
+func newNetworkError(err error) *UpstreamError {
+	upstreamErr := &UpstreamError{Type: errTypeNetwork, Body: err.Error()}
+
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCertErr):
+		upstreamErr.Type = errTypeTLSCert
+	case errors.As(err, &dnsErr):
+		upstreamErr.Type = errTypeDNS
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		upstreamErr.Type = errTypeTLSTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		upstreamErr.Type = errTypeTimeout
+	}
+	return upstreamErr
+}
+
+func (e *UpstreamError) Error() string {
+	var msg string
+	if e.Type == errTypeTLSCert {
+		msg = fmt.Sprintf("TLS 证书校验失败, 请检查代理或系统证书配置: %s", e.Body)
+	} else if e.StatusCode == 0 {
+		msg = fmt.Sprintf("请求失败: %s", e.Body)
+	} else {
+		msg = fmt.Sprintf("非200响应: %d, 内容: %s", e.StatusCode, e.Body)
+	}
+	if e.Step != "" {
+		return e.Step + "失败: " + msg
+	}
+	return msg
+}
+
+// modelUnavailableTypes 为上游表示所请求模型暂不可用的错误类型
+var modelUnavailableTypes = map[string]bool{
+	"ERR_MODEL_UNAVAILABLE":   true,
+	"ERR_MODEL_NOT_AVAILABLE": true,
+	"ERR_MODEL_NOT_FOUND":     true,
+	"ERR_UNSUPPORTED_MODEL":   true,
+}
+
+// ModelUnavailable 判断上游是否因所请求的模型不可用而拒绝，此时重试同一模型没有意义
+func (e *UpstreamError) ModelUnavailable() bool {
+	return modelUnavailableTypes[strings.ToUpper(e.Type)]
+}
+
+// Retryable 网络错误、418/429 限流以及 5xx 错误值得重试
+func (e *UpstreamError) Retryable() bool {
+	switch {
+	case e.Type == errTypeTLSCert, e.ModelUnavailable():
+		return false
+	case e.StatusCode == 0:
+		return true
+	case e.StatusCode == http.StatusTeapot, e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode >= http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// ClientStatus 将上游错误映射为返回给客户端的状态码
+func (e *UpstreamError) ClientStatus() int {
+	switch {
+	case e.ModelUnavailable():
+		return http.StatusServiceUnavailable
+	case e.StatusCode == http.StatusTeapot, e.StatusCode == http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// paramError 表示某个请求参数不合法，Param 为 OpenAI 错误对象中的 param 字段
+type paramError struct {
+	Param   string
+	Message string
+}
+
+func (e *paramError) Error() string {
+	return e.Message
+}
+
+// invalidRequestError 构造 OpenAI 风格的 invalid_request_error，param 为空时输出 null
+func invalidRequestError(message, param string) map[string]interface{} {
+	var paramValue interface{}
+	if param != "" {
+		paramValue = param
+	}
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    "invalid_request_error",
+			"param":   paramValue,
+			"code":    nil,
+		},
+	}
+}
+
+// errorParam 返回错误对应的参数名，无法确定时返回空字符串
+func errorParam(err error) string {
+	var pErr *paramError
+	if errors.As(err, &pErr) {
+		return pErr.Param
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Field
+	}
+	return ""
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamError(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		body           string
+		retryAfter     string
+		wantType       string
+		wantRetryAfter time.Duration
+		wantRetryable  bool
+		wantClient     int
+	}{
+		{"418 被拦截", http.StatusTeapot, `{"type":"ERR_BN_LIMIT"}`, "", "ERR_BN_LIMIT", 0, true, http.StatusTooManyRequests},
+		{"429 带 Retry-After", http.StatusTooManyRequests, "", "3", "", 3 * time.Second, true, http.StatusTooManyRequests},
+		{"5xx", http.StatusBadGateway, "bad gateway", "", "", 0, true, http.StatusBadGateway},
+		{"4xx 不可重试", http.StatusBadRequest, `{"type":"ERR_INVALID"}`, "", "ERR_INVALID", 0, false, http.StatusBadGateway},
+		{"模型不可用", http.StatusBadRequest, `{"type":"ERR_MODEL_UNAVAILABLE"}`, "", "ERR_MODEL_UNAVAILABLE", 0, false, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if tt.retryAfter != "" {
+				w.Header().Set("Retry-After", tt.retryAfter)
+			}
+			w.WriteHeader(tt.status)
+			w.WriteString(tt.body)
+
+			var err error = newUpstreamError(w.Result())
+			var upstreamErr *UpstreamError
+			if !errors.As(err, &upstreamErr) {
+				t.Fatalf("错误类型 %T 不是 *UpstreamError", err)
+			}
+			if upstreamErr.StatusCode != tt.status {
+				t.Errorf("StatusCode = %d, want %d", upstreamErr.StatusCode, tt.status)
+			}
+			if upstreamErr.Body != tt.body {
+				t.Errorf("Body = %q, want %q", upstreamErr.Body, tt.body)
+			}
+			if upstreamErr.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", upstreamErr.Type, tt.wantType)
+			}
+			if upstreamErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("RetryAfter = %v, want %v", upstreamErr.RetryAfter, tt.wantRetryAfter)
+			}
+			if got := upstreamErr.Retryable(); got != tt.wantRetryable {
+				t.Errorf("Retryable() = %v, want %v", got, tt.wantRetryable)
+			}
+			if got := upstreamErr.ClientStatus(); got != tt.wantClient {
+				t.Errorf("ClientStatus() = %d, want %d", got, tt.wantClient)
+			}
+		})
+	}
+}
+
+func TestWithStep(t *testing.T) {
+	err := withStep(&UpstreamError{StatusCode: http.StatusTeapot}, stepToken)
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.Step != stepToken {
+		t.Fatalf("withStep 未记录步骤: %v", err)
+	}
+	if got, want := err.Error(), stepToken+"失败: 非200响应: 418, 内容: "; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	plain := errors.New("plain")
+	if withStep(plain, stepChat) != plain {
+		t.Error("非 UpstreamError 应原样返回")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNewNetworkError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantType      string
+		wantRetryable bool
+	}{
+		{"DNS 解析失败", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "duckduckgo.com"}}, errTypeDNS, true},
+		{"证书校验失败", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, errTypeTLSCert, false},
+		{"证书域名不匹配", fmt.Errorf("wrapped: %w", x509.HostnameError{Host: "duckduckgo.com", Certificate: &x509.Certificate{}}), errTypeTLSCert, false},
+		{"TLS 握手超时", errors.New("net/http: TLS handshake timeout"), errTypeTLSTimeout, true},
+		{"连接超时", &net.OpError{Op: "dial", Err: timeoutError{}}, errTypeTimeout, true},
+		{"其他网络错误", errors.New("connection reset by peer"), errTypeNetwork, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamErr := newNetworkError(tt.err)
+			if upstreamErr.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", upstreamErr.Type, tt.wantType)
+			}
+			if got := upstreamErr.Retryable(); got != tt.wantRetryable {
+				t.Errorf("Retryable() = %v, want %v", got, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+func TestCompletionNetworkErrorRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		// failDials 为前几次拨号返回 DNS 错误的次数
+		failDials   int32
+		verifyCert  bool
+		want        int
+		wantAttempt int32
+	}{
+		{"DNS 错误重试后成功", 1, false, http.StatusOK, 2},
+		{"证书错误立即失败", 0, true, http.StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.RetryDelay = 0
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+			})
+			server := withUpstream(t, &scriptedUpstream{})
+
+			var dials atomic.Int32
+			upstreamTransport = &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					if dials.Add(1) <= tt.failDials {
+						return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "duckduckgo.com", IsTemporary: true}}
+					}
+					return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+				},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: !tt.verifyCert},
+			}
+
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if got := dials.Load(); got != tt.wantAttempt {
+				t.Errorf("拨号次数 = %d, want %d", got, tt.wantAttempt)
+			}
+		})
+	}
+}
+
+func TestInvalidRequestErrorParam(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		want      int
+		wantParam interface{}
+	}{
+		{"合法请求", `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, nil},
+		{"temperature 超出范围", `{"model":"gpt-4o-mini","temperature":3,"messages":[{"role":"user","content":"hi"}]}`, http.StatusBadRequest, "temperature"},
+		{"max_tokens 小于 1", `{"model":"gpt-4o-mini","max_tokens":0,"messages":[{"role":"user","content":"hi"}]}`, http.StatusBadRequest, "max_tokens"},
+		{"字段类型错误", `{"model":"gpt-4o-mini","top_p":"x","messages":[{"role":"user","content":"hi"}]}`, http.StatusBadRequest, "top_p"},
+		{"无法确定字段时为 null", `{"model":`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &scriptedUpstream{})
+			w := postCompletion(t, handleCompletion, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusOK {
+				return
+			}
+			var resp struct {
+				Error map[string]interface{} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的错误响应: %v", err)
+			}
+			if resp.Error["type"] != "invalid_request_error" {
+				t.Errorf("type = %v, want invalid_request_error", resp.Error["type"])
+			}
+			if param, ok := resp.Error["param"]; !ok || param != tt.wantParam {
+				t.Errorf("param = %v (present %v), want %v", param, ok, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"未提供", "", 0},
+		{"秒数", "3", 3 * time.Second},
+		{"负数", "-1", 0},
+		{"已过期的 HTTP 日期", "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+		{"无法解析", "soon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	// HTTP 日期按与当前时间的差值计算
+	future := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got <= 8*time.Second || got > 10*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want 约 10s", future, got)
+	}
+}
+
+func TestHonorRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		honor   bool
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"关闭时使用 RETRY_DELAY", false, 0, 250 * time.Millisecond},
+		{"默认等待 Retry-After, 不超过 RETRY_AFTER_MAX", true, 300 * time.Millisecond, 900 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.HonorRetryAfter = tt.honor
+				c.RetryAfterMax = 300 * time.Millisecond
+				c.MaxRetryCount = 2
+				c.RetryDelay = 0
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+				c.AdaptiveBlocking = false
+			})
+			upstream := &scriptedUpstream{}
+			var limited atomic.Bool
+			withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/duckchat/v1/chat" && limited.CompareAndSwap(false, true) {
+					w.Header().Set("Retry-After", "1")
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				upstream.ServeHTTP(w, r)
+			}))
+
+			start := time.Now()
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			elapsed := time.Since(start)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if elapsed < tt.wantMin || elapsed > tt.wantMax {
+				t.Errorf("耗时 %v, want %v 到 %v", elapsed, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// streamFilter 对上游增量文本做处理，可以跨 chunk 缓冲内容；
+// Flush 在流结束时调用，返回仍缓冲着的剩余内容
+type streamFilter interface {
+	Push(text string) string
+	Flush() string
+}
+
+// newStreamFilters 根据配置构建过滤链，流式与非流式响应共用
+func newStreamFilters() []streamFilter {
+	// UTF-8 缓冲始终放在最前面，保证后续过滤器只处理完整字符
+	filters := []streamFilter{&utf8Filter{}}
+	if config.StripChars != "" {
+		filters = append(filters, charStripFilter(config.StripChars))
+	}
+	if config.StripThink {
+		filters = append(filters, &thinkFilter{start: config.ThinkStart, end: config.ThinkEnd})
+	}
+	if config.StripRoleEcho && len(config.RoleEchoPatterns) > 0 {
+		filters = append(filters, &roleEchoFilter{patterns: config.RoleEchoPatterns})
+	}
+	return filters
+}
+
+func pushFilters(filters []streamFilter, text string) string {
+	for _, f := range filters {
+		text = f.Push(text)
+	}
+	return text
+}
+
+func flushFilters(filters []streamFilter) string {
+	var text string
+	for _, f := range filters {
+		text = f.Push(text) + f.Flush()
+	}
+	return text
+}
+
+// applyFilters 对完整文本执行一次过滤链
+func applyFilters(filters []streamFilter, text string) string {
+	return pushFilters(filters, text) + flushFilters(filters)
+}
+
+// thinkFilter 移除 start 与 end 之间的推理内容，分隔符可能被拆分在多个 chunk 中
+type thinkFilter struct {
+	start   string
+	end     string
+	inThink bool
+	buf     string
+	// reasoning 记录被移除的推理内容，用于估算 reasoning_tokens
+	reasoning strings.Builder
+}
+
+func (f *thinkFilter) Push(text string) string {
+	f.buf += text
+	var out strings.Builder
+
+	for {
+		if !f.inThink {
+			if idx := strings.Index(f.buf, f.start); idx >= 0 {
+				out.WriteString(f.buf[:idx])
+				f.buf = f.buf[idx+len(f.start):]
+				f.inThink = true
+				continue
+			}
+			// 保留可能是起始分隔符前缀的尾部，等待下一个 chunk
+			keep := partialSuffixLen(f.buf, f.start)
+			out.WriteString(f.buf[:len(f.buf)-keep])
+			f.buf = f.buf[len(f.buf)-keep:]
+			return out.String()
+		}
+
+		if idx := strings.Index(f.buf, f.end); idx >= 0 {
+			f.reasoning.WriteString(f.buf[:idx])
+			f.buf = f.buf[idx+len(f.end):]
+			f.inThink = false
+			continue
+		}
+		keep := partialSuffixLen(f.buf, f.end)
+		f.reasoning.WriteString(f.buf[:len(f.buf)-keep])
+		f.buf = f.buf[len(f.buf)-keep:]
+		return out.String()
+	}
+}
+
+func (f *thinkFilter) Flush() string {
+	// 未闭合的推理块直接丢弃
+	if f.inThink {
+		f.reasoning.WriteString(f.buf)
+		f.buf = ""
+		return ""
+	}
+	rest := f.buf
+	f.buf = ""
+	return rest
+}
+
+// reasoningText 返回过滤链中 thinkFilter 移除的推理内容，未启用 STRIP_THINK 时为空
+func reasoningText(filters []streamFilter) string {
+	for _, f := range filters {
+		if think, ok := f.(*thinkFilter); ok {
+			return think.reasoning.String()
+		}
+	}
+	return ""
+}
+
+// partialSuffixLen 返回 s 的尾部与 delim 前缀重合的最大长度
+func partialSuffixLen(s, delim string) int {
+	for n := len(delim) - 1; n > 0; n-- {
+		if n <= len(s) && strings.HasSuffix(s, delim[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// utf8Filter 缓存被拆分到下一个 chunk 的多字节字符，只输出完整的字符，
+// 避免中文、emoji 等在流式输出中出现乱码。上游以 \ud83d、\ude00 两个 chunk 分别发送
+// 代理对时，decodeRawJSONString 将其保留为 WTF-8 字节，这里合并为完整字符
+type utf8Filter struct {
+	pending string
+}
+
+func (f *utf8Filter) Push(text string) string {
+	s := joinSurrogates(f.pending + text)
+	cut := len(s)
+	if isHighSurrogateSuffix(s) {
+		cut = len(s) - 3
+	} else {
+		for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(s[i]) {
+				if !utf8.FullRuneInString(s[i:]) {
+					cut = i
+				}
+				break
+			}
+		}
+	}
+	f.pending = s[cut:]
+	return strings.ToValidUTF8(s[:cut], "\uFFFD")
+}
+
+// isHighSurrogateSuffix 判断 s 是否以 WTF-8 编码的高位代理项（ED A0..AF xx）结尾
+func isHighSurrogateSuffix(s string) bool {
+	n := len(s)
+	return n >= 3 && s[n-3] == 0xED && s[n-2] >= 0xA0 && s[n-2] <= 0xAF
+}
+
+// joinSurrogates 将相邻的 WTF-8 高位、低位代理项合并为一个 4 字节的 UTF-8 字符
+func joinSurrogates(s string) string {
+	if !strings.Contains(s, "\xED") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if i+6 <= len(s) && isHighSurrogateSuffix(s[:i+3]) && s[i+3] == 0xED && s[i+4] >= 0xB0 && s[i+4] <= 0xBF {
+			hi := rune(s[i]&0x0F)<<12 | rune(s[i+1]&0x3F)<<6 | rune(s[i+2]&0x3F)
+			lo := rune(s[i+3]&0x0F)<<12 | rune(s[i+4]&0x3F)<<6 | rune(s[i+5]&0x3F)
+			b.WriteRune(utf16.DecodeRune(hi, lo))
+			i += 5
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// decodeRawJSONString 解码 JSON 字符串字面量并保留原始字节：非法或不完整的 UTF-8 原样保留，
+// 单独的 \uD800-\uDFFF 代理项按 WTF-8 编码，不像 encoding/json 那样替换为 U+FFFD；
+// raw 不是字符串时返回 false
+func decodeRawJSONString(raw []byte) (string, bool) {
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return "", false
+	}
+	raw = raw[1 : len(raw)-1]
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' {
+			b.WriteByte(raw[i])
+			continue
+		}
+		i++
+		if i >= len(raw) {
+			return "", false
+		}
+		switch raw[i] {
+		case '"', '\\', '/':
+			b.WriteByte(raw[i])
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if i+5 > len(raw) {
+				return "", false
+			}
+			code, err := strconv.ParseUint(string(raw[i+1:i+5]), 16, 16)
+			if err != nil {
+				return "", false
+			}
+			i += 4
+			r := rune(code)
+			if utf16.IsSurrogate(r) {
+				// 同一字符串内的完整代理对直接合并，单独的代理项留给 utf8Filter 跨 chunk 合并
+				if r < 0xDC00 && i+7 <= len(raw) && raw[i+1] == '\\' && raw[i+2] == 'u' {
+					if low, err := strconv.ParseUint(string(raw[i+3:i+7]), 16, 16); err == nil {
+						if combined := utf16.DecodeRune(r, rune(low)); combined != utf8.RuneError {
+							b.WriteRune(combined)
+							i += 6
+							continue
+						}
+					}
+				}
+				b.Write([]byte{0xED, byte(0x80 | (r>>6)&0x3F), byte(0x80 | r&0x3F)})
+				continue
+			}
+			b.WriteRune(r)
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
+func (f *utf8Filter) Flush() string {
+	// 流结束时仍不完整的字节无法还原，替换为 U+FFFD
+	rest := strings.ToValidUTF8(f.pending, "\uFFFD")
+	f.pending = ""
+	return rest
+}
+
+// charStripFilter 移除上游在 token 之间插入的零宽或填充字符
+type charStripFilter string
+
+func (f charStripFilter) Push(text string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(string(f), r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func (f charStripFilter) Flush() string {
+	return ""
+}
+
+// roleEchoFilter 移除回复开头回显的角色标签（不区分大小写），
+// 开头内容不足以判断时先缓冲，判断完成后其余内容直接放行
+type roleEchoFilter struct {
+	patterns []string
+	buf      string
+	decided  bool
+	// 已移除标签，继续跳过标签后的空白
+	trimSpace bool
+}
+
+func (f *roleEchoFilter) Push(text string) string {
+	if f.decided {
+		return f.trim(text)
+	}
+
+	f.buf += text
+	head := strings.ToLower(strings.TrimLeft(f.buf, " \t\r\n"))
+	for _, pattern := range f.patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(head, pattern) {
+			f.decided, f.trimSpace = true, true
+			rest := strings.TrimLeft(f.buf, " \t\r\n")[len(pattern):]
+			f.buf = ""
+			return f.trim(rest)
+		}
+		if strings.HasPrefix(pattern, head) {
+			// 仍可能是角色标签，等待更多内容
+			return ""
+		}
+	}
+
+	f.decided = true
+	rest := f.buf
+	f.buf = ""
+	return rest
+}
+
+func (f *roleEchoFilter) trim(text string) string {
+	if !f.trimSpace {
+		return text
+	}
+	text = strings.TrimLeft(text, " \t")
+	if text != "" {
+		f.trimSpace = false
+	}
+	return text
+}
+
+func (f *roleEchoFilter) Flush() string {
+	rest := f.buf
+	f.buf = ""
+	return rest
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// streamThroughUTF8 模拟上游 SSE 响应，经 readUpstreamChunks 解码后送入 utf8Filter
+func streamThroughUTF8(t *testing.T, body string) []string {
+	t.Helper()
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	filter := &utf8Filter{}
+	var out []string
+	err := readUpstreamChunks(resp, func(chunk map[string]interface{}) error {
+		if msg, ok := chunkMessage(chunk); ok {
+			out = append(out, filter.Push(msg))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readUpstreamChunks: %v", err)
+	}
+	return append(out, filter.Flush())
+}
+
+func TestReadUpstreamChunksSplitUTF8(t *testing.T) {
+	zhong := "中" // E4 B8 AD
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "多字节字符的原始字节被拆开",
+			body: "data: {\"message\":\"a" + zhong[:1] + "\"}\n\n" +
+				"data: {\"message\":\"" + zhong[1:] + "b\"}\n\n" +
+				"data: [DONE]\n\n",
+			want: "a中b",
+		},
+		{
+			name: "代理对被拆到两个 chunk",
+			body: "data: {\"message\":\"\\ud83d\"}\n\n" +
+				"data: {\"message\":\"\\ude00!\"}\n\n" +
+				"data: [DONE]\n\n",
+			want: "😀!",
+		},
+		{
+			name: "同一 chunk 内的代理对与转义",
+			body: "data: {\"message\":\"\\ud83d\\ude00\\n\\\"x\\\"\"}\n\n" +
+				"data: [DONE]\n\n",
+			want: "😀\n\"x\"",
+		},
+		{
+			name: "流结束时仍不完整的字节",
+			body: "data: {\"message\":\"ok" + zhong[:2] + "\"}\n\n" +
+				"data: [DONE]\n\n",
+			want: "ok\uFFFD",
+		},
+		{
+			name: "单独的低位代理项",
+			body: "data: {\"message\":\"\\ude00x\"}\n\n" +
+				"data: [DONE]\n\n",
+			want: "\uFFFDx",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := streamThroughUTF8(t, tt.body)
+			for i, part := range parts {
+				if strings.ContainsRune(part, '\uFFFD') && !strings.ContainsRune(tt.want, '\uFFFD') {
+					t.Errorf("第 %d 段输出出现 U+FFFD: %q", i, part)
+				}
+			}
+			if got := strings.Join(parts, ""); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRawJSONString(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"普通字符串", `"hello"`, "hello", true},
+		{"转义字符", `"a\tb\/c\\"`, "a\tb/c\\", true},
+		{"BMP 字符", `"\u4e2d"`, "中", true},
+		{"单独的高位代理项", `"\ud83d"`, "\xed\xa0\xbd", true},
+		{"非字符串", `123`, "", false},
+		{"null", `null`, "", false},
+		{"非法转义", `"\x"`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decodeRawJSONString([]byte(tt.raw))
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("decodeRawJSONString(%s) = %q, %v; want %q, %v", tt.raw, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestThinkFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"同一 chunk 内", []string{"a<think>x</think>b"}, "ab"},
+		{"分隔符被拆开", []string{"a<th", "ink>x</th", "ink>b"}, "ab"},
+		{"多个推理块", []string{"<think>x</think>a<think>y</think>b"}, "ab"},
+		{"未闭合的推理块", []string{"a<think>x"}, "a"},
+		{"不完整的分隔符前缀", []string{"a<th"}, "a<th"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := &thinkFilter{start: "<think>", end: "</think>"}
+			var got strings.Builder
+			for _, chunk := range tt.chunks {
+				got.WriteString(filter.Push(chunk))
+			}
+			got.WriteString(filter.Flush())
+			if got.String() != tt.want {
+				t.Errorf("got %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamStripThink(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip bool
+		want  string
+	}{
+		{"默认保留推理内容", false, "a<think>x</think>b"},
+		{"STRIP_THINK 移除推理内容", true, "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.StripThink = tt.strip })
+			chunks, _ := runStream(t, messageSource("a<th", "ink>x</think>", "b"), nil)
+			if got := streamedContent(chunks); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamStripChars(t *testing.T) {
+	tests := []struct {
+		name  string
+		chars string
+		want  string
+	}{
+		{"默认不移除", "", "a\u200bb\u200c!"},
+		{"STRIP_CHARS 移除填充字符", "\u200b\u200c", "ab!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.StripChars = tt.chars })
+			chunks, _ := runStream(t, messageSource("a\u200b", "b\u200c", "!"), nil)
+			if got := streamedContent(chunks); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleEchoFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"同一 chunk 内", []string{"assistant: hello"}, "hello"},
+		{"标签被拆开", []string{"assi", "stant:", " hel", "lo"}, "hello"},
+		{"不区分大小写与前导空白", []string{"\n Assistant:hello"}, "hello"},
+		{"没有标签", []string{"hello assistant:"}, "hello assistant:"},
+		{"疑似前缀后结束", []string{"assi"}, "assi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := &roleEchoFilter{patterns: []string{"assistant:"}}
+			var got strings.Builder
+			for _, chunk := range tt.chunks {
+				got.WriteString(filter.Push(chunk))
+			}
+			got.WriteString(filter.Flush())
+			if got.String() != tt.want {
+				t.Errorf("got %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamStripRoleEcho(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip bool
+		want  string
+	}{
+		{"默认保留", false, "assistant: hello"},
+		{"STRIP_ROLE_ECHO 移除角色标签", true, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StripRoleEcho = tt.strip
+				c.RoleEchoPatterns = []string{"assistant:"}
+			})
+			chunks, _ := runStream(t, messageSource("assistant:", " hello"), nil)
+			if got := streamedContent(chunks); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var (
+	chromeVersionRe = regexp.MustCompile(`Chrome/((\d+)[\d.]*)`)
+	edgeVersionRe   = regexp.MustCompile(`Edg/((\d+)[\d.]*)`)
+)
+
+// syncClientHints 根据 User-Agent 中的浏览器版本重新生成 Sec-Ch-Ua 系列请求头，
+// 避免自定义 User-Agent 后客户端提示与之不一致而被拦截
+func syncClientHints(headers map[string]string) {
+	chrome := chromeVersionRe.FindStringSubmatch(headers["User-Agent"])
+	if chrome == nil {
+		return
+	}
+
+	brand, fullVersion, major := "Google Chrome", chrome[1], chrome[2]
+	if edge := edgeVersionRe.FindStringSubmatch(headers["User-Agent"]); edge != nil {
+		brand, fullVersion, major = "Microsoft Edge", edge[1], edge[2]
+	}
+
+	headers["Sec-Ch-Ua"] = fmt.Sprintf(`"%s";v="%s", "Not=A?Brand";v="24", "Chromium";v="%s"`, brand, major, chrome[2])
+	headers["Sec-Ch-Ua-Full-Version-List"] = fmt.Sprintf(`"%s";v="%s", "Not=A?Brand";v="24.0.0.0", "Chromium";v="%s"`, brand, fullVersion, chrome[1])
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestSyncClientHints(t *testing.T) {
+	const (
+		defaultSecChUa = `"Microsoft Edge";v="129", "Not(A:Brand";v="8", "Chromium";v="129"`
+		chrome140      = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.7339.81 Safari/537.36"
+		edge140        = chrome140 + " Edg/140.0.3485.54"
+		firefoxUA      = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:130.0) Gecko/20100101 Firefox/130.0"
+	)
+	tests := []struct {
+		name         string
+		userAgent    string
+		wantUa       string
+		wantFullList string
+	}{
+		{
+			name:         "Chrome 140",
+			userAgent:    chrome140,
+			wantUa:       `"Google Chrome";v="140", "Not=A?Brand";v="24", "Chromium";v="140"`,
+			wantFullList: `"Google Chrome";v="140.0.7339.81", "Not=A?Brand";v="24.0.0.0", "Chromium";v="140.0.7339.81"`,
+		},
+		{
+			name:         "Edge 140",
+			userAgent:    edge140,
+			wantUa:       `"Microsoft Edge";v="140", "Not=A?Brand";v="24", "Chromium";v="140"`,
+			wantFullList: `"Microsoft Edge";v="140.0.3485.54", "Not=A?Brand";v="24.0.0.0", "Chromium";v="140.0.7339.81"`,
+		},
+		{
+			name:      "非 Chromium 浏览器保持默认",
+			userAgent: firefoxUA,
+			wantUa:    defaultSecChUa,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := fakeHeaders()
+			headers["User-Agent"] = tt.userAgent
+			syncClientHints(headers)
+			if got := headers["Sec-Ch-Ua"]; got != tt.wantUa {
+				t.Errorf("Sec-Ch-Ua = %s, want %s", got, tt.wantUa)
+			}
+			if got := headers["Sec-Ch-Ua-Full-Version-List"]; got != tt.wantFullList {
+				t.Errorf("Sec-Ch-Ua-Full-Version-List = %s, want %s", got, tt.wantFullList)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleLivez 只表示进程存活，不访问上游；panics 为启动以来恢复的 panic 次数
+func handleLivez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "panics": panicTotal.Load()})
+}
+
+// readyzProbeInterval 内没有任何 token 获取结果时，readyz 才会自行请求一次上游
+const readyzProbeInterval = 30 * time.Second
+
+// tokenFetchResult 记录最近一次获取 token 的时间与结果，供 readyz 判断上游是否可用
+type tokenFetchResult struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+var lastTokenFetch = &tokenFetchResult{}
+
+func (r *tokenFetchResult) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.at, r.err = time.Now(), err
+}
+
+func (r *tokenFetchResult) get() (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.at, r.err
+}
+
+// handleReadyz 检查能否获取上游 token，以及是否因 418 过多而处于最大退让状态；
+// 优先依据已缓存的 token 与最近一次获取结果判断，不会从 token 池租用 token，
+// 最近没有获取记录时才请求一次上游
+func handleReadyz(c *gin.Context) {
+	if config.AdaptiveBlocking && upstreamBlocks.factor() >= config.AdaptiveMaxFactor {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "上游拦截频繁, 已达到最大退让"})
+		return
+	}
+
+	if upstreamTokenPool != nil && len(upstreamTokenPool.tokens) > 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	if _, ok := tokenCache.get(tokenCacheKey); ok {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+
+	at, err := lastTokenFetch.get()
+	if at.IsZero() || time.Since(at) > readyzProbeInterval {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+		var token string
+		if token, err = fetchToken(ctx); err == nil && config.TokenCacheTTL > 0 {
+			tokenCache.set(tokenCacheKey, token, config.TokenCacheTTL)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getReadyz(t *testing.T) int {
+	t.Helper()
+	r := gin.New()
+	r.GET("/readyz", handleReadyz)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return w.Code
+}
+
+func TestHandleReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		pooled     int
+		cached     bool
+		lastErr    error
+		lastAge    time.Duration
+		upstream   []int
+		wantCode   int
+		wantPooled int
+		wantStatus int32
+	}{
+		{name: "池中有 token 时不租用", pooled: 1, wantCode: http.StatusOK, wantPooled: 1},
+		{name: "有缓存的 token", cached: true, wantCode: http.StatusOK},
+		{name: "最近一次获取失败", lastErr: errors.New("boom"), lastAge: time.Second, wantCode: http.StatusServiceUnavailable},
+		{name: "最近一次获取成功", lastAge: time.Second, wantCode: http.StatusOK},
+		{name: "没有近期结果时探测一次", lastAge: time.Hour, upstream: []int{http.StatusTeapot}, wantCode: http.StatusServiceUnavailable, wantStatus: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AdaptiveBlocking = false
+				c.TokenCacheTTL = time.Minute
+			})
+			upstream := &scriptedUpstream{status: tt.upstream}
+			withUpstream(t, upstream)
+
+			savedPool := upstreamTokenPool
+			upstreamTokenPool = nil
+			if tt.pooled > 0 {
+				upstreamTokenPool = &tokenPool{tokens: make(chan pooledToken, tt.pooled), refill: make(chan struct{}, tt.pooled)}
+				for i := 0; i < tt.pooled; i++ {
+					upstreamTokenPool.tokens <- pooledToken{value: testVQD, fetched: time.Now()}
+				}
+			}
+			if tt.cached {
+				tokenCache.set(tokenCacheKey, testVQD, time.Minute)
+			}
+			lastTokenFetch.record(tt.lastErr)
+			lastTokenFetch.at = time.Now().Add(-tt.lastAge)
+			pool := upstreamTokenPool
+			t.Cleanup(func() {
+				upstreamTokenPool = savedPool
+				tokenCache.flush()
+				lastTokenFetch.record(nil)
+			})
+
+			if got := getReadyz(t); got != tt.wantCode {
+				t.Errorf("status = %d, want %d", got, tt.wantCode)
+			}
+			if pool != nil && len(pool.tokens) != tt.wantPooled {
+				t.Errorf("池中 token = %d, want %d", len(pool.tokens), tt.wantPooled)
+			}
+			if got := upstream.statusCalls.Load(); got != tt.wantStatus {
+				t.Errorf("token 请求 %d 次, want %d", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestFetchTokenCancellationNotRecorded(t *testing.T) {
+	withUpstream(t, &scriptedUpstream{})
+	lastTokenFetch.record(nil)
+	t.Cleanup(func() { lastTokenFetch.record(nil) })
+
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{"调用方取消", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}},
+		{"调用方超时", func() (context.Context, context.CancelFunc) {
+			return context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			if _, err := fetchToken(ctx); err == nil {
+				t.Fatal("已取消的 ctx 应返回错误")
+			}
+			if _, err := lastTokenFetch.get(); err != nil {
+				t.Errorf("取消被记录为上游失败: %v", err)
+			}
+			if got := getReadyz(t); got != http.StatusOK {
+				t.Errorf("readyz = %d, want 200", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "unicode"
+
+// acceptLanguages 为各文字对应的上游 Accept-Language
+var acceptLanguages = map[string]string{
+	"zh": "zh-CN,zh;q=0.9,en;q=0.8",
+	"ja": "ja-JP,ja;q=0.9,en;q=0.8",
+	"ko": "ko-KR,ko;q=0.9,en;q=0.8",
+	"ru": "ru-RU,ru;q=0.9,en;q=0.8",
+	"en": "en-US,en;q=0.9",
+}
+
+// detectLanguage 按文字统计粗略判断文本的主要语言：出现假名即视为日文，
+// 否则取汉字、谚文、西里尔字母与拉丁字母中数量最多的一种；没有可识别的字母时返回空字符串
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			return "ja"
+		case unicode.Is(unicode.Han, r):
+			counts["zh"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["en"]++
+		}
+	}
+
+	best := ""
+	for _, lang := range []string{"zh", "ko", "ru", "en"} {
+		if counts[lang] > counts[best] {
+			best = lang
+		}
+	}
+	return best
+}
+
+// detectAcceptLanguage 根据最后一条 user 消息的语言返回 Accept-Language，无法判断时返回空字符串
+func detectAcceptLanguage(messages []ChatMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return acceptLanguages[detectLanguage(messageText(messages[i]))]
+		}
+	}
+	return ""
+}
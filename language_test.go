@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestFakeHeadersAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   string
+		unset bool
+		want  string
+	}{
+		{"默认值", "", true, "zh-CN,zh;q=0.9"},
+		{"ACCEPT_LANGUAGE 覆盖", "en-US,en;q=0.9", false, "en-US,en;q=0.9"},
+		{"单一语言", "ja", false, "ja"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ACCEPT_LANGUAGE", tt.env)
+			if tt.unset {
+				os.Unsetenv("ACCEPT_LANGUAGE")
+			}
+			if got := fakeHeaders()["Accept-Language"]; got != tt.want {
+				t.Errorf("Accept-Language = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"你好，请介绍一下自己", "zh"},
+		{"hello, who are you?", "en"},
+		{"こんにちは世界", "ja"},
+		{"안녕하세요", "ko"},
+		{"Привет, мир", "ru"},
+		{"用 Go 写一个 HTTP server", "en"},
+		{"12345 !?", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := detectLanguage(tt.text); got != tt.want {
+				t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		prompt  string
+		want    string
+	}{
+		{"默认使用固定的 Accept-Language", false, "hello there", config.FakeHeaders["Accept-Language"]},
+		{"中文提示词", true, "你好", acceptLanguages["zh"]},
+		{"英文提示词", true, "hello there", acceptLanguages["en"]},
+		{"无法判断时使用固定值", true, "12345", config.FakeHeaders["Accept-Language"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AutoAcceptLanguage = tt.enabled
+				c.ResponseCacheTTL = 0
+			})
+			var mu sync.Mutex
+			var got string
+			upstream := &scriptedUpstream{}
+			withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/duckchat/v1/chat" {
+					mu.Lock()
+					got = r.Header.Get("Accept-Language")
+					mu.Unlock()
+				}
+				upstream.ServeHTTP(w, r)
+			}))
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"`+tt.prompt+`"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got != tt.want {
+				t.Errorf("上游 Accept-Language = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
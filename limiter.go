@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyLimiter 统计每个客户端进行中的请求数，计数归零时删除条目避免 map 无限增长。
+// released 在每次释放时关闭并替换，用于唤醒排队中的请求
+type keyLimiter struct {
+	mu       sync.Mutex
+	active   map[string]int
+	released chan struct{}
+}
+
+var concurrencyLimiter = &keyLimiter{active: make(map[string]int), released: make(chan struct{})}
+
+func (l *keyLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[key]--
+	if l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// acquireWait 在并发已满时最多等待 maxWait，期间有请求释放就重试占位
+func (l *keyLimiter) acquireWait(ctx context.Context, key string, limit int, maxWait time.Duration) bool {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		if l.active[key] < limit {
+			l.active[key]++
+			l.mu.Unlock()
+			return true
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// perKeyConcurrencyMiddleware 限制单个 API key 同时进行中的请求数，防止单个客户端占满上游
+func perKeyConcurrencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.PerKeyConcurrency <= 0 {
+			c.Next()
+			return
+		}
+
+		key := clientKey(c)
+		limit := adaptiveConcurrency(config.PerKeyConcurrency)
+		if !concurrencyLimiter.acquireWait(c.Request.Context(), key, limit, config.QueueMaxWait) {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "并发请求过多, 请稍后重试"})
+			return
+		}
+		defer concurrencyLimiter.release(key)
+		c.Next()
+	}
+}
+
+// parseModelRateLimits 解析 MODEL_RATE_LIMITS，模型 id 统一规范化，非正数的限额忽略
+func parseModelRateLimits(raw string) map[string]float64 {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]float64
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		log.Printf("MODEL_RATE_LIMITS 解析失败, 已忽略: %v", err)
+		return nil
+	}
+	limits := make(map[string]float64, len(parsed))
+	for id, rps := range parsed {
+		if rps > 0 {
+			limits[normalizeModelID(id)] = rps
+		}
+	}
+	return limits
+}
+
+// tokenBucket 按 rps 匀速补充令牌，容量取 max(1, rps) 以允许少量突发
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// modelRateLimiter 为配置了限额的模型各维护一个令牌桶，在调用上游前检查
+type modelRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var modelLimiter = &modelRateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow 按上游模型名查找对应的公开模型 id 及其限额，未配置限额的模型直接放行
+func (l *modelRateLimiter) allow(upstreamModel string) bool {
+	id := normalizeModelID(upstreamModel)
+	if info, ok := findUpstreamModel(upstreamModel); ok {
+		id = normalizeModelID(info.ID)
+	}
+	rps, ok := config.ModelRateLimits[id]
+	if !ok {
+		return true
+	}
+	capacity := rps
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket, ok := l.buckets[id]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[id] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rps
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
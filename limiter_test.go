@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPerKeyConcurrencyMiddleware(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		// held 为占用中的请求所属的 key，随后以 key 发起一个新请求
+		held []string
+		key  string
+		want int
+	}{
+		{"默认不限制", 0, []string{"a", "a", "a"}, "a", http.StatusOK},
+		{"未达上限", 2, []string{"a"}, "a", http.StatusOK},
+		{"超过上限返回 429", 2, []string{"a", "a"}, "a", http.StatusTooManyRequests},
+		{"不同 key 互不影响", 2, []string{"a", "a"}, "b", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PerKeyConcurrency = tt.limit
+				c.QueueMaxWait = 0
+				c.AdaptiveBlocking = false
+			})
+			release := make(chan struct{})
+			var entered sync.WaitGroup
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				c.Set(apiKeyContextKey, c.GetHeader("X-Test-Key"))
+			}, perKeyConcurrencyMiddleware(), func(c *gin.Context) {
+				if c.GetHeader("X-Hold") != "" {
+					entered.Done()
+					<-release
+				}
+				c.Status(http.StatusOK)
+			})
+
+			var done sync.WaitGroup
+			for _, key := range tt.held {
+				entered.Add(1)
+				done.Add(1)
+				go func(key string) {
+					defer done.Done()
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.Header.Set("X-Test-Key", key)
+					req.Header.Set("X-Hold", "1")
+					r.ServeHTTP(httptest.NewRecorder(), req)
+				}(key)
+			}
+			entered.Wait()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Test-Key", tt.key)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			close(release)
+			done.Wait()
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			concurrencyLimiter.mu.Lock()
+			remaining := len(concurrencyLimiter.active)
+			concurrencyLimiter.mu.Unlock()
+			if remaining != 0 {
+				t.Errorf("请求结束后仍有 %d 个 key 的计数未清理", remaining)
+			}
+		})
+	}
+}
+
+func TestPerKeyConcurrencyQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxWait time.Duration
+		// holdFor 为占用中的请求在新请求到达后继续占用的时长
+		holdFor time.Duration
+		want    int
+	}{
+		{"默认立即返回 429", 0, 50 * time.Millisecond, http.StatusTooManyRequests},
+		{"排队期间释放后继续", time.Second, 50 * time.Millisecond, http.StatusOK},
+		{"排队超时返回 429", 30 * time.Millisecond, 300 * time.Millisecond, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PerKeyConcurrency = 1
+				c.QueueMaxWait = tt.maxWait
+				c.AdaptiveBlocking = false
+			})
+			entered := make(chan struct{})
+			r := gin.New()
+			r.GET("/", perKeyConcurrencyMiddleware(), func(c *gin.Context) {
+				if c.GetHeader("X-Hold") != "" {
+					close(entered)
+					time.Sleep(tt.holdFor)
+				}
+				c.Status(http.StatusOK)
+			})
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Hold", "1")
+				r.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			<-entered
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			<-done
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseModelRateLimits(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want map[string]float64
+	}{
+		{"", nil},
+		{"not json", nil},
+		{`{"O3-Mini": 0.5, "gpt-4o-mini": 0, "claude-3-haiku": -1}`, map[string]float64{"o3-mini": 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := parseModelRateLimits(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseModelRateLimits(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelRateLimiter(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits map[string]float64
+		model  string
+		// want 为连续请求的放行结果
+		want []bool
+	}{
+		{"默认不限速", nil, "o3-mini", []bool{true, true, true}},
+		{"按上游模型名匹配限额", map[string]float64{"claude-3-haiku": 0.01}, "claude-3-haiku-20240307", []bool{true, false, false}},
+		{"容量随 rps 增加", map[string]float64{"o3-mini": 2}, "o3-mini", []bool{true, true, false}},
+		{"其他模型不受影响", map[string]float64{"o3-mini": 0.01}, "gpt-4o-mini", []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ModelRateLimits = tt.limits })
+			limiter := &modelRateLimiter{buckets: make(map[string]*tokenBucket)}
+			for i, want := range tt.want {
+				if got := limiter.allow(tt.model); got != want {
+					t.Errorf("第 %d 次 allow(%q) = %v, want %v", i+1, tt.model, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestModelRateLimitResponse(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ModelRateLimits = map[string]float64{"gpt-4o-mini": 0.01}
+		c.ResponseCacheTTL = 0
+	})
+	saved := modelLimiter
+	modelLimiter = &modelRateLimiter{buckets: make(map[string]*tokenBucket)}
+	t.Cleanup(func() { modelLimiter = saved })
+	withUpstream(t, &scriptedUpstream{})
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+		if w.Code != want {
+			t.Errorf("status = %d, want %d, body = %s", w.Code, want, w.Body.String())
+		}
+	}
+}
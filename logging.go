@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// setupLogging 配置了 LOG_FILE 时将日志写入按大小滚动的文件，否则保持输出到 stderr
+func setupLogging() {
+	if config.LogFile == "" {
+		return
+	}
+
+	writer := &lumberjack.Logger{
+		Filename:   config.LogFile,
+		MaxSize:    config.LogMaxSize,
+		MaxBackups: config.LogMaxBackups,
+	}
+	log.SetOutput(writer)
+	gin.DefaultWriter = writer
+	gin.DefaultErrorWriter = writer
+}
+
+// sensitiveHeaders 在日志中只保留前几个字符，其余以 * 遮盖
+var sensitiveHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"X-Api-Key":     true,
+	"X-Vqd-4":       true,
+}
+
+// redactHeaders 将请求头格式化为日志文本，敏感头的值被遮盖
+func redactHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		value := strings.Join(header.Values(name), ", ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			value = maskSecret(value)
+		}
+		b.WriteString(name + ": " + value + "; ")
+	}
+	return strings.TrimSuffix(b.String(), "; ")
+}
+
+// maskSecret 保留 Bearer 前缀与前 4 个字符，便于区分不同的 key 而不泄露完整内容
+func maskSecret(value string) string {
+	prefix := ""
+	if strings.HasPrefix(value, "Bearer ") {
+		prefix, value = "Bearer ", strings.TrimPrefix(value, "Bearer ")
+	}
+	if len(value) <= 4 {
+		return prefix + "****"
+	}
+	return prefix + value[:4] + "****"
+}
+
+// truncateForLog 截断过长的文本并注明原始长度
+func truncateForLog(body []byte, limit int) string {
+	if limit <= 0 || len(body) <= limit {
+		return string(body)
+	}
+	return strings.ToValidUTF8(string(body[:limit]), "") + "...(共 " + strconv.Itoa(len(body)) + " 字节)"
+}
+
+// redactURL 返回遮盖了 api_key 查询参数的 URL 字符串，原 URL 不受影响
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	if !query.Has("api_key") {
+		return u.String()
+	}
+	for i, value := range query["api_key"] {
+		query["api_key"][i] = maskSecret(value)
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// accessLogger 与 gin.Logger 输出相同格式的访问日志，但会遮盖路径中的 api_key 查询参数
+func accessLogger() gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{Formatter: accessLogFormatter})
+}
+
+// accessLogFormatter 沿用 gin 默认的日志格式，只替换 Path
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	if u, err := url.Parse(param.Path); err == nil {
+		param.Path = redactURL(u)
+	}
+
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
+
+// debugLogRequest 在 DEBUG 模式下记录请求详情，请求头经过遮盖、请求体按 DEBUG_BODY_MAX 截断
+func debugLogRequest(label, method, url string, header http.Header, body []byte) {
+	if !config.Debug {
+		return
+	}
+	log.Printf("[DEBUG] %s %s %s 请求头: %s 请求体: %s", label, method, url, redactHeaders(header), truncateForLog(body, config.DebugBodyMax))
+}
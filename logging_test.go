@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"/v1/chat/completions", "/v1/chat/completions"},
+		{"/v1/chat/completions?stream=true", "/v1/chat/completions?stream=true"},
+		{"/v1/chat/completions?api_key=sk-secret-key", "/v1/chat/completions?api_key=sk-s%2A%2A%2A%2A"},
+		{"/v1/chat/completions?a=1&api_key=abc", "/v1/chat/completions?a=1&api_key=%2A%2A%2A%2A"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			u, _ := url.Parse(tt.raw)
+			if got := redactURL(u); got != tt.want {
+				t.Errorf("redactURL(%s) = %s, want %s", tt.raw, got, tt.want)
+			}
+			if u.String() != tt.raw {
+				t.Errorf("原 URL 被修改: %s", u)
+			}
+		})
+	}
+}
+
+func TestAccessLoggerRedactsAPIKey(t *testing.T) {
+	var buf bytes.Buffer
+	saved := gin.DefaultWriter
+	gin.DefaultWriter = &buf
+	t.Cleanup(func() { gin.DefaultWriter = saved })
+
+	r := gin.New()
+	r.Use(accessLogger())
+	r.GET("/v1/models", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name     string
+		target   string
+		wantPath string
+	}{
+		{"带 api_key", "/v1/models?api_key=sk-secret-value&x=1", `"/v1/models?api_key=sk-s%2A%2A%2A%2A&x=1"`},
+		{"不带查询参数", "/v1/models", `"/v1/models"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+			line := buf.String()
+			if strings.Contains(line, "secret-value") {
+				t.Errorf("访问日志中出现了完整的 key: %s", line)
+			}
+			if !strings.Contains(line, tt.wantPath) || !strings.HasPrefix(line, "[GIN] ") {
+				t.Errorf("访问日志 = %q, want path %s", line, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     bool
+		wantFile bool
+	}{
+		{"默认输出到 stderr", false, false},
+		{"LOG_FILE 写入文件", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ddg.log")
+			withConfig(t, func(c *Config) {
+				c.LogFile = ""
+				if tt.file {
+					c.LogFile = path
+				}
+			})
+			savedOutput, savedWriter, savedErrorWriter := log.Writer(), gin.DefaultWriter, gin.DefaultErrorWriter
+			t.Cleanup(func() {
+				if closer, ok := log.Writer().(io.Closer); ok && log.Writer() != savedOutput {
+					closer.Close()
+				}
+				log.SetOutput(savedOutput)
+				gin.DefaultWriter, gin.DefaultErrorWriter = savedWriter, savedErrorWriter
+			})
+
+			setupLogging()
+			log.Printf("setup logging test")
+
+			if got := log.Writer() != savedOutput; got != tt.wantFile {
+				t.Errorf("日志输出已替换 = %v, want %v", got, tt.wantFile)
+			}
+			data, err := os.ReadFile(path)
+			if got := err == nil && strings.Contains(string(data), "setup logging test"); got != tt.wantFile {
+				t.Errorf("日志文件包含日志行 = %v, want %v", got, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestDebugLogRequest(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer sk-secret-key")
+	header.Set("Content-Type", "application/json")
+	body := []byte(`{"messages":[{"role":"user","content":"hello world"}]}`)
+
+	tests := []struct {
+		name    string
+		debug   bool
+		bodyMax int
+		want    []string
+		notWant []string
+	}{
+		{"默认不记录", false, 0, nil, []string{"[DEBUG]"}},
+		{"遮盖 Authorization", true, 0, []string{"Authorization: Bearer sk-s****", "Content-Type: application/json", string(body)}, []string{"sk-secret-key"}},
+		{"按 DEBUG_BODY_MAX 截断请求体", true, 10, []string{`{"messages...(共 54 字节)`}, []string{"hello world"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.Debug = tt.debug
+				c.DebugBodyMax = tt.bodyMax
+			})
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			debugLogRequest("客户端请求", http.MethodPost, "/v1/chat/completions", header, body)
+			out := buf.String()
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("日志 %q 缺少 %q", out, s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(out, s) {
+					t.Errorf("日志 %q 不应包含 %q", out, s)
+				}
+			}
+		})
+	}
+}
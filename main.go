@@ -2,15 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -23,40 +29,492 @@ type Config struct {
 	RetryDelay    time.Duration
 	FakeHeaders   map[string]string
 	ProxyURL      string
+	// 非流式响应缓存有效期，单位毫秒，0 表示关闭
+	ResponseCacheTTL time.Duration
+	// 是否使用客户端的 Accept-Language 覆盖上游请求头
+	ForwardAcceptLanguage bool
+	// 是否移除 ThinkStart 与 ThinkEnd 之间的推理内容
+	StripThink bool
+	ThinkStart string
+	ThinkEnd   string
+	// 严格模式下请求体包含未知字段时返回 400
+	StrictJSON bool
+	// 各路由的服务端超时，0 表示不限制
+	ModelsTimeout     time.Duration
+	CompletionTimeout time.Duration
+	// 开发模式，开启后才允许使用调试类请求头
+	DevMode bool
+	// 注入到每个拼接后提示词最前面的全局说明
+	ConversationHeader string
+	// 管理接口使用的令牌，未配置时管理接口不可用
+	AdminToken string
+	// 模型健康检查的并发数
+	HealthProbeConcurrency int
+	// 是否合并相邻的同角色消息
+	MergeConsecutive bool
+	// 单个对话请求（含全部重试）的总时限，单位毫秒，0 表示不限制
+	RequestTimeout time.Duration
+	// 是否将 temperature 等采样参数转发给上游
+	ForwardSamplingParams bool
+	// 自定义模型目录文件（JSON），为空时使用内置目录
+	ModelsFile string
+	// 提示词估算 token 数超过阈值时自动切换到的模型，为空表示关闭
+	AutoUpgradeModel     string
+	AutoUpgradeThreshold int
+	// vqd token 缓存有效期，单位毫秒，0 表示每次请求都重新获取
+	TokenCacheTTL time.Duration
+	// 是否允许通过 X-DDG-Model 请求头强制指定模型
+	AllowModelOverride bool
+	// 转发前从输出中移除的字符（如零宽字符），支持 \u200b 形式的转义
+	StripChars string
+	// 日志文件路径及滚动策略（单文件 MB 数、保留的旧文件数）
+	LogFile       string
+	LogMaxSize    int
+	LogMaxBackups int
+	// 单个 API key 同时进行中的请求上限，0 表示不限制
+	PerKeyConcurrency int
+	// 是否移除回复开头回显的角色标签（如 "assistant:"）
+	StripRoleEcho    bool
+	RoleEchoPatterns []string
+	// 即使客户端要求流式输出也先完整缓冲再重放的模型
+	ForceBufferModels []string
+	// 是否按 OpenAI 规范校验请求体
+	ValidateSchema bool
+	// 上游请求体模板（JSON），支持 {{model}}、{{messages}}、{{content}} 占位符
+	UpstreamBodyTemplate map[string]interface{}
+	// 受信任的反向代理地址或网段，为空时不信任任何代理
+	TrustedProxies []string
+	// 上游连接的 TLS 参数：最低版本、密码套件与曲线偏好
+	TLSMinVersion string
+	TLSCiphers    []string
+	TLSCurves     []string
+	// 流式输出开始后出错时，以 OpenAI 风格的错误数据块通知客户端
+	StreamErrorAsChunk bool
+	// 并发超限时最长排队等待时间，为 0 时立即返回 429
+	QueueMaxWait time.Duration
+	// API key 文件，每行一个 key，# 开头为注释，可通过 /admin/reload 热加载
+	APIKeysFile string
+	// 按模型限速 (每秒请求数)，JSON 对象，如 {"o3-mini": 0.5}
+	ModelRateLimits map[string]float64
+	// 识别上游以正常内容返回的拒答，命中 RefusalPattern 时 finish_reason 设为 content_filter
+	DetectRefusals bool
+	// 拒答识别使用的正则表达式
+	RefusalPattern string
+	// 非流式请求命中拒答时直接返回错误而非正常响应
+	RefusalAsError bool
+	// 上游连接池参数，0 表示使用 Go 默认值或不限制
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	// 流式输出时跳过上游的空字符串增量，默认关闭，原样转发空增量
+	SkipEmptyDeltas bool
+	// 输出命中该正则时截断并以 stop 结束，可通过 X-DDG-Stop-Regex 按请求覆盖
+	StopRegex string
+	// 停止规则可匹配任意长度（含 *、+）时暂缓输出的字节数，匹配长度有上限时按上限计算
+	StopRegexHoldback int
+	// 流式响应的总时长上限，超过后以 finish_reason=length 结束，0 表示不限制
+	StreamMaxDuration time.Duration
+	// CORS 预检结果的缓存时间（秒），0 表示不返回 Access-Control-Max-Age
+	CORSMaxAge int
+	// CORS 允许的请求头；未配置时普通跨域请求回显预检中请求的头，携带凭据的请求使用内置列表
+	CORSAllowHeaders []string
+	// 启动时检查配置与上游连通性，失败则退出
+	StartupSelfTest bool
+	// 根据最近 418、429 与 5xx 的频率自动放大重试间隔并降低单 key 并发，上游请求成功后逐步回落
+	AdaptiveBlocking bool
+	// 统计上游错误的时间窗口
+	AdaptiveWindow time.Duration
+	// 退让系数上限，重试间隔最多放大到该倍数
+	AdaptiveMaxFactor int
+	// 后台维持的预取 token 数量，每个请求独占一个，0 表示不启用
+	TokenPoolSize int
+	// 回复后处理命令，通过 stdin 接收完整回复并以 stdout 作为新回复；流式响应会先缓冲再处理
+	PostprocessCmd string
+	// 后处理命令的超时时间
+	PostprocessTimeout time.Duration
+	// 多个上游代理，按轮询使用；被 418/429 拦截后下一次重试会避开该代理
+	ProxyURLs []string
+	// 流式数据块中附带非标准的 x_usage 字段，实时估算已用 token
+	StreamLiveUsage bool
+	// 拒绝访问的客户端 IP 或 CIDR
+	BlockedIPs []*net.IPNet
+	// 测试模式：命中 TestPromptsFile 中的提示词时直接返回固定回复，不请求上游
+	TestMode        bool
+	TestPromptsFile string
+	// 上游模型不可用时依次改用的模型，未配置时直接返回 503
+	FallbackModels []string
+	// 流式输出合并窗口，窗口内的增量合并为一个数据块，在下一个增量到达或流结束时输出；0 表示不合并
+	StreamCoalesce time.Duration
+	// 拼接提示词时每条消息后的行结束符
+	PromptLineTerminator string
+	// 去掉提示词末尾多余的分号与行结束符
+	TrimTrailingSeparator bool
+	// 将历史 assistant 消息中的 tool_calls 转为文本附加到该消息，避免丢失上下文
+	SerializeToolCalls bool
+	// 流式响应开始时立即发送 role 为 assistant、内容为空的首个数据块
+	InitialRoleChunk bool
+	// 输出请求详情调试日志，敏感请求头会被遮盖
+	Debug bool
+	// 调试日志中请求体的最大字节数，超出部分截断
+	DebugBodyMax int
+	// 额外的模型别名，JSON 对象，如 {"gpt-4-turbo": "claude-3-haiku"}，与内置别名合并
+	ModelAliases map[string]string
+	// 多个 API key，逗号分隔；与 APIKEY、APIKEYS_FILE 取并集
+	APIKeys []string
+	// 允许携带凭据跨域访问的来源，命中时回显该 Origin 并允许凭据；未配置时仅返回 *
+	CORSOrigins []string
+	// 客户端请求头的最大字节数，超出时返回 431
+	MaxHeaderBytes int
+	// 处理函数 panic 时在日志中输出调用栈
+	PanicStackTrace bool
+	// 模型 id 中表示后缀开始的字符，该字符及之后的部分在查找模型前被去掉，如 gpt-4o-mini@latest
+	ModelSuffixSeparators string
+	// 模型 id 中表示前缀结束的字符，最后一个该字符之前的部分在查找模型前被去掉，如 openai/gpt-4o-mini
+	ModelPrefixSeparators string
+	// 未配置任何 API key 时拒绝受保护路由的请求，避免意外暴露为开放代理
+	RequireAuth bool
+	// 对话请求的默认上游超时，模型目录中的 timeout_ms 可单独覆盖
+	UpstreamTimeout time.Duration
+	// 为每次对话返回会话 id（X-Conversation-Id 头与 conversation_id 字段），下一轮带上该 id 时延续同一个上游会话
+	ConversationIDs bool
+	// 会话 id 的有效期，超过后重新开始上游会话
+	ConversationTTL time.Duration
+	// 最多同时保存的会话数，超过时淘汰最早过期的会话；0 表示不限制
+	ConversationMax int
+	// 流式响应中单个数据块写入客户端的最长时间，客户端读取过慢超过该时间时中止响应；0 表示不限制
+	StreamWriteTimeout time.Duration
+	// 合并窗口内累积的内容超过该字节数时立即输出，避免缓冲无限增长
+	StreamMaxBuffer int
+	// 请求的模型近期频繁被 418 拦截时，自动改用 FALLBACK_MODELS 中第一个健康的模型
+	AutoRouteHealthy bool
+	// 窗口内 418 次数达到该值时将模型视为不健康
+	UnhealthyThreshold int
+	// 统计模型 418 次数的时间窗口
+	UnhealthyWindow time.Duration
+	// 输出诊断用响应头（X-Request-ID、X-Upstream-Model、X-Retry-Count、X-Cache、耗时），生产环境可关闭
+	ExposeDiagHeaders bool
+	// 允许通过 ?api_key= 查询参数传入 API key，仅在未提供 Authorization 头时使用
+	AllowQueryAPIKey bool
+	// 单条消息过长时的处理方式: split（拆成多条连续消息）、truncate（截断并附加提示），留空不处理
+	SplitLargeMessages string
+	// SPLIT_LARGE_MESSAGES 生效时单条消息的最大字符数
+	MaxMessageChars int
+	// 根据最后一条 user 消息的语言（中日韩俄英）设置上游 Accept-Language，客户端转发的值优先
+	AutoAcceptLanguage bool
+	// 在非流式响应的 usage 中返回本次请求的重试次数（retries 字段）
+	ReportRetries bool
+	// 流式请求先在重试保护下完整读取上游响应，再以 SSE 重放给客户端，以首字延迟换取完整性
+	ReliableStream bool
+	// 上游 429 响应带 Retry-After 时，下一次重试至少等待该时长
+	HonorRetryAfter bool
+	// 遵循 Retry-After 时单次等待的上限
+	RetryAfterMax time.Duration
+	// 限定 API key 可使用的模型，JSON 对象，如 {"key1": ["gpt-4o-mini"], "key2": ["*"]}；未列出的 key 不受限制
+	KeyScopes map[string][]string
+	// 拼接提示词前去掉每行末尾空白、将连续空行合并为一行，代码块内保持原样
+	CompactWhitespace bool
+	// 同时进行的 token 获取数上限，超出的请求等待；0 表示不限制
+	TokenFetchConcurrency int
+	// 流式响应的第一个数据块在 delta 中携带 role: assistant，之后的数据块不再携带
+	FirstDeltaRole bool
+	// 请求缺少 model 字段时返回 400，而不是使用默认模型 gpt-4o-mini
+	RequireModel bool
+	// 输出被截断（finish_reason 为 length 或 STOP_REGEX 命中）时另起一行附加的提示文字，如 [truncated]；留空不附加
+	TruncationNotice string
+	// 响应缓存最多保存的条目数，0 表示不限制
+	ResponseCacheMax int
+	// 清理各缓存中过期条目的间隔，0 表示只在读取时清理
+	CacheSweepInterval time.Duration
+}
+
+type ChatMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+	// Name 区分多人对话中的发言者，拼接时输出为 role(name)
+	Name string `json:"name,omitempty"`
+	// ToolCalls 为其他后端生成的历史 assistant 消息中的工具调用
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// ToolCall 为 OpenAI 格式的函数调用
+type ToolCall struct {
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type ChatRequest struct {
+	Model            string        `json:"model"`
+	Messages         []ChatMessage `json:"messages"`
+	Stream           bool          `json:"stream"`
+	Temperature      *float64      `json:"temperature,omitempty"`
+	TopP             *float64      `json:"top_p,omitempty"`
+	MaxTokens        *int          `json:"max_tokens,omitempty"`
+	PresencePenalty  *float64      `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty"`
+	Stop             interface{}   `json:"stop,omitempty"`
+	User             string        `json:"user,omitempty"`
+	Logprobs         bool          `json:"logprobs,omitempty"`
 }
 
 var config Config
 
+// fakeHeaders 返回模拟浏览器的上游请求头，Accept-Language 可由 ACCEPT_LANGUAGE 覆盖
+func fakeHeaders() map[string]string {
+	return map[string]string{
+		"Accept":             "*/*",
+		"Accept-Encoding":    "gzip, deflate, br, zstd",
+		"Accept-Language":    getEnv("ACCEPT_LANGUAGE", "zh-CN,zh;q=0.9"),
+		"Origin":             "https://duckduckgo.com/",
+		"Cookie":             "l=wt-wt; ah=wt-wt; dcm=6",
+		"Dnt":                "1",
+		"Priority":           "u=1, i",
+		"Referer":            "https://duckduckgo.com/",
+		"Sec-Ch-Ua":          `"Microsoft Edge";v="129", "Not(A:Brand";v="8", "Chromium";v="129"`,
+		"Sec-Ch-Ua-Mobile":   "?0",
+		"Sec-Ch-Ua-Platform": `"Windows"`,
+		"Sec-Fetch-Dest":     "empty",
+		"Sec-Fetch-Mode":     "cors",
+		"Sec-Fetch-Site":     "same-origin",
+		"User-Agent":         "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/127.0.0.0 Safari/537.36",
+	}
+}
+
 func init() {
 	godotenv.Load()
 	config = Config{
-		APIPrefix:     getEnv("API_PREFIX", "/"),
-			MaxRetryCount: getIntEnv("MAX_RETRY_COUNT", 3),
-			RetryDelay:    getDurationEnv("RETRY_DELAY", 5000),
-			ProxyURL:      getEnv("PROXY_URL", ""),
-			FakeHeaders: map[string]string{
-				"Accept":             "*/*",
-				"Accept-Encoding":    "gzip, deflate, br, zstd",
-				"Accept-Language":    "zh-CN,zh;q=0.9",
-				"Origin":             "https://duckduckgo.com/",
-				"Cookie":             "l=wt-wt; ah=wt-wt; dcm=6",
-				"Dnt":                "1",
-				"Priority":           "u=1, i",
-				"Referer":            "https://duckduckgo.com/",
-				"Sec-Ch-Ua":          `"Microsoft Edge";v="129", "Not(A:Brand";v="8", "Chromium";v="129"`,
-				"Sec-Ch-Ua-Mobile":   "?0",
-				"Sec-Ch-Ua-Platform": `"Windows"`,
-				"Sec-Fetch-Dest":     "empty",
-				"Sec-Fetch-Mode":     "cors",
-				"Sec-Fetch-Site":     "same-origin",
-				"User-Agent":         "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/127.0.0.0 Safari/537.36",
-			},
+		APIPrefix:              getEnv("API_PREFIX", "/"),
+		MaxRetryCount:          getIntEnv("MAX_RETRY_COUNT", 3),
+		RetryDelay:             getDurationEnv("RETRY_DELAY", 5000),
+		ProxyURL:               getEnv("PROXY_URL", ""),
+		ResponseCacheTTL:       getDurationEnv("RESPONSE_CACHE_TTL", 0),
+		ForwardAcceptLanguage:  getBoolEnv("FORWARD_ACCEPT_LANGUAGE", false),
+		StripThink:             getBoolEnv("STRIP_THINK", false),
+		ThinkStart:             getEnv("THINK_START", "<think>"),
+		ThinkEnd:               getEnv("THINK_END", "</think>"),
+		StrictJSON:             getBoolEnv("STRICT_JSON", false),
+		ModelsTimeout:          getDurationEnv("MODELS_TIMEOUT", 5000),
+		CompletionTimeout:      getDurationEnv("COMPLETION_TIMEOUT", 300000),
+		DevMode:                getBoolEnv("DEV_MODE", false),
+		ConversationHeader:     getEnv("CONVERSATION_HEADER", ""),
+		AdminToken:             getEnv("ADMIN_TOKEN", ""),
+		HealthProbeConcurrency: getIntEnv("HEALTH_PROBE_CONCURRENCY", 2),
+		MergeConsecutive:       getBoolEnv("MERGE_CONSECUTIVE", false),
+		RequestTimeout:         getDurationEnv("REQUEST_TIMEOUT", 0),
+		ForwardSamplingParams:  getBoolEnv("FORWARD_SAMPLING_PARAMS", false),
+		ModelsFile:             getEnv("MODELS_FILE", ""),
+		AutoUpgradeModel:       getEnv("AUTO_UPGRADE_MODEL", ""),
+		AutoUpgradeThreshold:   getIntEnv("AUTO_UPGRADE_THRESHOLD", 8000),
+		TokenCacheTTL:          getDurationEnv("TOKEN_CACHE_TTL", 0),
+		AllowModelOverride:     getBoolEnv("ALLOW_MODEL_OVERRIDE", false),
+		StripChars:             getEscapedEnv("STRIP_CHARS", ""),
+		LogFile:                getEnv("LOG_FILE", ""),
+		LogMaxSize:             getIntEnv("LOG_MAX_SIZE", 100),
+		LogMaxBackups:          getIntEnv("LOG_MAX_BACKUPS", 3),
+		PerKeyConcurrency:      getIntEnv("PER_KEY_CONCURRENCY", 0),
+		StripRoleEcho:          getBoolEnv("STRIP_ROLE_ECHO", false),
+		RoleEchoPatterns:       getListEnv("ROLE_ECHO_PATTERNS", []string{"assistant:"}),
+		ForceBufferModels:      getListEnv("FORCE_BUFFER_MODELS", nil),
+		ValidateSchema:         getBoolEnv("VALIDATE_SCHEMA", false),
+		UpstreamBodyTemplate:   loadBodyTemplate(getEnv("UPSTREAM_BODY_TEMPLATE", "")),
+		TrustedProxies:         getListEnv("TRUSTED_PROXIES", nil),
+		TLSMinVersion:          getEnv("UPSTREAM_TLS_MIN_VERSION", "1.2"),
+		TLSCiphers:             getListEnv("UPSTREAM_TLS_CIPHERS", nil),
+		TLSCurves:              getListEnv("UPSTREAM_TLS_CURVES", nil),
+		StreamErrorAsChunk:     getBoolEnv("STREAM_ERROR_AS_CHUNK", false),
+		QueueMaxWait:           getDurationEnv("QUEUE_MAX_WAIT", 0),
+		APIKeysFile:            getEnv("APIKEYS_FILE", ""),
+		ModelRateLimits:        parseModelRateLimits(getEnv("MODEL_RATE_LIMITS", "")),
+		DetectRefusals:         getBoolEnv("DETECT_REFUSALS", false),
+		RefusalPattern:         getEnv("REFUSAL_PATTERN", defaultRefusalPattern),
+		RefusalAsError:         getBoolEnv("REFUSAL_AS_ERROR", false),
+		MaxIdleConns:           getIntEnv("MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:    getIntEnv("MAX_IDLE_CONNS_PER_HOST", 0),
+		MaxConnsPerHost:        getIntEnv("MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:        getDurationEnv("IDLE_CONN_TIMEOUT", 90000),
+		SkipEmptyDeltas:        getBoolEnv("SKIP_EMPTY_DELTAS", false),
+		StopRegex:              getEnv("STOP_REGEX", ""),
+		StopRegexHoldback:      getIntEnv("STOP_REGEX_HOLDBACK", 256),
+		StreamMaxDuration:      getDurationEnv("STREAM_MAX_DURATION", 0),
+		CORSMaxAge:             getIntEnv("CORS_MAX_AGE", 7200),
+		CORSAllowHeaders:       getListEnv("CORS_ALLOW_HEADERS", nil),
+		StartupSelfTest:        getBoolEnv("STARTUP_SELFTEST", false),
+		AdaptiveBlocking:       getBoolEnv("ADAPTIVE_BLOCKING", false),
+		AdaptiveWindow:         getDurationEnv("ADAPTIVE_WINDOW", 60000),
+		AdaptiveMaxFactor:      getIntEnv("ADAPTIVE_MAX_FACTOR", 8),
+		TokenPoolSize:          getIntEnv("TOKEN_POOL_SIZE", 0),
+		PostprocessCmd:         getEnv("POSTPROCESS_CMD", ""),
+		PostprocessTimeout:     getDurationEnv("POSTPROCESS_TIMEOUT", 5000),
+		ProxyURLs:              getListEnv("PROXY_URLS", nil),
+		StreamLiveUsage:        getBoolEnv("STREAM_LIVE_USAGE", false),
+		BlockedIPs:             parseBlockedIPs(getListEnv("BLOCKED_IPS", nil)),
+		TestMode:               getBoolEnv("TEST_MODE", false),
+		TestPromptsFile:        getEnv("TEST_PROMPTS_FILE", ""),
+		FallbackModels:         getListEnv("FALLBACK_MODELS", nil),
+		StreamCoalesce:         getDurationEnv("STREAM_COALESCE_MS", 0),
+		PromptLineTerminator:   getEscapedEnv("PROMPT_LINE_TERMINATOR", "\r\n"),
+		TrimTrailingSeparator:  getBoolEnv("TRIM_TRAILING_SEPARATOR", true),
+		SerializeToolCalls:     getBoolEnv("SERIALIZE_TOOL_CALLS", false),
+		InitialRoleChunk:       getBoolEnv("INITIAL_ROLE_CHUNK", false),
+		Debug:                  getBoolEnv("DEBUG", false),
+		DebugBodyMax:           getIntEnv("DEBUG_BODY_MAX", 2048),
+		ModelAliases:           parseModelAliases(getEnv("MODEL_ALIASES", "")),
+		APIKeys:                getListEnv("APIKEYS", nil),
+		CORSOrigins:            getListEnv("CORS_ORIGINS", nil),
+		MaxHeaderBytes:         getIntEnv("MAX_HEADER_BYTES", 64<<10),
+		PanicStackTrace:        getBoolEnv("PANIC_STACK_TRACE", true),
+		ModelSuffixSeparators:  getEnv("MODEL_SUFFIX_SEPARATORS", "@:"),
+		ModelPrefixSeparators:  getEnv("MODEL_PREFIX_SEPARATORS", "/"),
+		RequireAuth:            getBoolEnv("REQUIRE_AUTH", false),
+		UpstreamTimeout:        getDurationEnv("UPSTREAM_TIMEOUT", 30000),
+		ConversationIDs:        getBoolEnv("CONVERSATION_IDS", false),
+		ConversationTTL:        getDurationEnv("CONVERSATION_TTL", 1800000),
+		ConversationMax:        getIntEnv("CONVERSATION_MAX", 10000),
+		StreamWriteTimeout:     getDurationEnv("STREAM_WRITE_TIMEOUT", 30000),
+		StreamMaxBuffer:        getIntEnv("STREAM_MAX_BUFFER", 65536),
+		AutoRouteHealthy:       getBoolEnv("AUTO_ROUTE_HEALTHY", false),
+		UnhealthyThreshold:     getIntEnv("UNHEALTHY_THRESHOLD", 3),
+		UnhealthyWindow:        getDurationEnv("UNHEALTHY_WINDOW", 60000),
+		ExposeDiagHeaders:      getBoolEnv("EXPOSE_DIAG_HEADERS", true),
+		AllowQueryAPIKey:       getBoolEnv("ALLOW_QUERY_API_KEY", false),
+		SplitLargeMessages:     getEnv("SPLIT_LARGE_MESSAGES", ""),
+		MaxMessageChars:        getIntEnv("MAX_MESSAGE_CHARS", 20000),
+		AutoAcceptLanguage:     getBoolEnv("AUTO_ACCEPT_LANGUAGE", false),
+		ReportRetries:          getBoolEnv("REPORT_RETRIES", false),
+		ReliableStream:         getBoolEnv("RELIABLE_STREAM", false),
+		HonorRetryAfter:        getBoolEnv("HONOR_RETRY_AFTER", true),
+		RetryAfterMax:          getDurationEnv("RETRY_AFTER_MAX", 60000),
+		KeyScopes:              parseKeyScopes(getEnv("KEY_SCOPES", "")),
+		CompactWhitespace:      getBoolEnv("COMPACT_WHITESPACE", false),
+		TokenFetchConcurrency:  getIntEnv("MAX_CONCURRENT_TOKEN_FETCHES", 0),
+		FirstDeltaRole:         getBoolEnv("FIRST_DELTA_ROLE", true),
+		RequireModel:           getBoolEnv("REQUIRE_MODEL", false),
+		TruncationNotice:       getEnv("TRUNCATION_NOTICE", ""),
+		ResponseCacheMax:       getIntEnv("RESPONSE_CACHE_MAX", 1000),
+		CacheSweepInterval:     getDurationEnv("CACHE_SWEEP_INTERVAL", 60000),
+		FakeHeaders:            fakeHeaders(),
+	}
+
+	setupLogging()
+	upstreamProxies = newProxyRotation(config.ProxyURLs)
+
+	if config.StopRegex != "" {
+		re, err := regexp.Compile(config.StopRegex)
+		if err != nil {
+			log.Printf("STOP_REGEX 无效, 已忽略: %v", err)
+		} else {
+			stopRegex = re
+		}
+	}
+
+	if config.DetectRefusals {
+		if err := compileRefusalPattern(config.RefusalPattern); err != nil {
+			log.Printf("REFUSAL_PATTERN 无效, 已关闭拒答识别: %v", err)
+			config.DetectRefusals = false
+		}
+	}
+
+	// 分隔符为空时 thinkFilter 无法定位推理块，会死循环或丢弃全部输出
+	if config.StripThink && (config.ThinkStart == "" || config.ThinkEnd == "") {
+		log.Printf("THINK_START 与 THINK_END 不能为空, 已关闭推理内容移除")
+		config.StripThink = false
+	}
+
+	if config.ModelsFile != "" {
+		if err := loadModelCatalog(config.ModelsFile); err != nil {
+			log.Printf("加载模型目录失败, 使用内置目录: %v", err)
+		}
+	}
+
+	if config.TestMode && config.TestPromptsFile != "" {
+		if err := loadTestPrompts(config.TestPromptsFile); err != nil {
+			log.Printf("加载测试提示词失败: %v", err)
+		}
+	}
+
+	if os.Getenv("APIKEY") != "" && len(config.APIKeys) > 0 {
+		log.Printf("同时配置了 APIKEY 与 APIKEYS, 两者中的 key 均可使用")
+	}
+
+	if config.APIKeysFile != "" {
+		if err := apiKeys.load(config.APIKeysFile); err != nil {
+			log.Printf("加载 API key 文件失败: %v", err)
+		}
+	}
+	if config.TokenFetchConcurrency > 0 {
+		tokenFetchSlots = make(chan struct{}, config.TokenFetchConcurrency)
+	}
+
+	switch config.SplitLargeMessages {
+	case "", splitModeSplit, splitModeTruncate:
+	default:
+		log.Printf("SPLIT_LARGE_MESSAGES 无效: %s, 已关闭长消息处理", config.SplitLargeMessages)
+		config.SplitLargeMessages = ""
+	}
+
+	if config.RequireAuth && !authEnabled() {
+		log.Printf("已启用 REQUIRE_AUTH 但未配置任何 API key, 对话接口将拒绝所有请求")
+	}
+
+	responseCache.maxEntries = config.ResponseCacheMax
+	conversationCache.maxEntries = config.ConversationMax
+
+	// 自定义 User-Agent 时同步更新客户端提示头
+	if userAgent := getEnv("USER_AGENT", ""); userAgent != "" {
+		config.FakeHeaders["User-Agent"] = userAgent
+		syncClientHints(config.FakeHeaders)
 	}
 }
 
 func main() {
-	r := gin.Default()
-	r.Use(corsMiddleware())
+	if config.StartupSelfTest && !reportSelfTest(runSelfTest()) {
+		log.Println("启动自检失败, 退出")
+		os.Exit(1)
+	}
+
+	if config.TokenPoolSize > 0 {
+		upstreamTokenPool = startTokenPool(config.TokenPoolSize)
+	}
+	startCacheSweeper(config.CacheSweepInterval, responseCache, tokenCache, conversationCache)
+
+	r, err := newRouter()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8787"
+	}
+	server := newServer(":"+port, r)
+	log.Printf("服务启动于端口 %s", port)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("服务异常退出: %v", err)
+	}
+}
+
+// newServer 创建 HTTP 服务；超过 MaxHeaderBytes 的请求由 net/http 直接以 431 拒绝，不会进入处理器
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+}
+
+// newRouter 注册全部中间件与路由
+func newRouter() (*gin.Engine, error) {
+	r := gin.New()
+	r.Use(accessLogger(), recoveryMiddleware())
+	// 默认不信任任何代理，ClientIP 即直连地址，避免通过 X-Forwarded-For 伪造
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES 配置无效: %v", err)
+	}
+	r.Use(requestIDMiddleware(), blockedIPMiddleware(), corsMiddleware())
 
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "API 服务运行中~"})
@@ -66,238 +524,1008 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"message": "pong"})
 	})
 
-	r.GET(config.APIPrefix+"/v1/models", func(c *gin.Context) {
-		models := []gin.H{
-			{"id": "gpt-4o-mini", "object": "model", "owned_by": "ddg"},
-			{"id": "claude-3-haiku", "object": "model", "owned_by": "ddg"},
-			{"id": "llama-3.1-70b", "object": "model", "owned_by": "ddg"},
-			{"id": "mixtral-8x7b", "object": "model", "owned_by": "ddg"},
+	r.GET("/livez", handleLivez)
+	r.GET("/readyz", handleReadyz)
+
+	r.GET(config.APIPrefix+"/v1/models", timeoutMiddleware(config.ModelsTimeout), func(c *gin.Context) {
+		models := make([]gin.H, 0, len(modelCatalog))
+		for _, info := range modelCatalog {
+			models = append(models, info.toOpenAI())
 		}
 		c.JSON(http.StatusOK, gin.H{"object": "list", "data": models})
 	})
 
-	r.POST(config.APIPrefix+"/v1/chat/completions", handleCompletion)
+	r.GET(config.APIPrefix+"/v1/models/:model", timeoutMiddleware(config.ModelsTimeout), func(c *gin.Context) {
+		info, ok := findModel(c.Param("model"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("模型不存在: %s", c.Param("model"))})
+			return
+		}
+		c.JSON(http.StatusOK, info.toOpenAI())
+	})
+
+	r.POST(config.APIPrefix+"/v1/chat/completions",
+		timeoutMiddleware(config.CompletionTimeout),
+		apiKeyAuthMiddleware(),
+		perKeyConcurrencyMiddleware(),
+		handleCompletion,
+	)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8787"
-	}
-	r.Run(":" + port)
+	admin := r.Group("/admin", adminAuthMiddleware())
+	admin.GET("/models/health", handleModelsHealth)
+	admin.POST("/cache/flush", handleCacheFlush)
+	admin.POST("/reload", handleReload)
+	admin.GET("/config", handleConfig)
+	admin.Any("/ddg/*path", handleDDGPassthrough)
+
+	return r, nil
 }
 
 func handleCompletion(c *gin.Context) {
-	apiKey := os.Getenv("APIKEY")
-	authorizationHeader := c.GetHeader("Authorization")
+	timing := &requestTiming{start: time.Now()}
 
-	if apiKey != "" {
-		if authorizationHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "未提供 APIKEY"})
+	if config.ValidateSchema || config.Debug {
+		raw, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("读取请求体失败: %v", err)})
 			return
-		} else if !strings.HasPrefix(authorizationHeader, "Bearer ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "APIKEY 格式错误"})
+		}
+		debugLogRequest("客户端请求", c.Request.Method, redactURL(c.Request.URL), c.Request.Header, raw)
+		if violations := validateChatSchema(raw); config.ValidateSchema && len(violations) > 0 {
+			body := invalidRequestError("请求体不符合 OpenAI 规范: "+violations[0], violationParam(violations[0]))
+			body["violations"] = violations
+			c.JSON(http.StatusBadRequest, body)
 			return
-		} else {
-			providedToken := strings.TrimPrefix(authorizationHeader, "Bearer ")
-			if providedToken != apiKey {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "APIKEY无效"})
-				return
-			}
 		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(raw))
 	}
 
-	var req struct {
-		Model    string `json:"model"`
-		Messages []struct {
-			Role    string      `json:"role"`
-			Content interface{} `json:"content"`
-		} `json:"messages"`
-		Stream bool `json:"stream"`
+	var req ChatRequest
+	if err := bindChatRequest(c, &req); err != nil {
+		c.JSON(http.StatusBadRequest, invalidRequestError(err.Error(), errorParam(err)))
+		return
 	}
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := validateSamplingRanges(&req); err != nil {
+		c.JSON(http.StatusBadRequest, invalidRequestError(err.Error(), err.Param))
+		return
+	}
+	// 未开启 REQUIRE_MODEL 时缺少 model 的请求使用默认模型；允许的 X-DDG-Model 头同样视为指定了模型
+	modelOverridden := config.AllowModelOverride && c.GetHeader("X-DDG-Model") != ""
+	if config.RequireModel && strings.TrimSpace(req.Model) == "" && !modelOverridden {
+		c.JSON(http.StatusBadRequest, invalidRequestError("缺少 model 字段", "model"))
 		return
 	}
 
+	stopRe := stopRegex
+	if pattern := c.GetHeader("X-DDG-Stop-Regex"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, invalidRequestError(fmt.Sprintf("X-DDG-Stop-Regex 无效: %v", err), "X-DDG-Stop-Regex"))
+			return
+		}
+		stopRe = re
+	}
+
+	// 部分中间代理会剥离 SSE，客户端可要求降级为普通 JSON 响应
+	if req.Stream && c.GetHeader("X-DDG-No-SSE") != "" {
+		req.Stream = false
+	}
+
 	model := convertModel(req.Model)
-	content := prepareMessages(req.Messages)
+	apiKey := c.GetString(apiKeyContextKey)
+	if config.SplitLargeMessages != "" {
+		req.Messages = splitLargeMessages(req.Messages)
+	}
+	content := prepareMessages(req.Messages, model)
 	// log.Printf("messages: %v", content)
 
-	reqBody := map[string]interface{}{
-		"model": model,
-		"messages": []map[string]interface{}{
-			{
-				"role":    "user",
-				"content": content,
-			},
-		},
+	// 长提示词自动切换到上下文更大的模型
+	if config.AutoUpgradeModel != "" {
+		if tokens := estimateTokens(content); tokens > config.AutoUpgradeThreshold {
+			upgraded := convertModel(config.AutoUpgradeModel)
+			if upgraded != model && keyAllowsModel(apiKey, upgraded) {
+				log.Printf("提示词约 %d tokens, 超过阈值 %d, 模型由 %s 切换为 %s", tokens, config.AutoUpgradeThreshold, model, upgraded)
+				model = upgraded
+			}
+		}
 	}
 
-	body, err := json.Marshal(reqBody)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("请求体序列化失败: %v", err)})
+	// 网关可能改写 body 中的 model，允许通过请求头强制指定
+	if override := c.GetHeader("X-DDG-Model"); config.AllowModelOverride && override != "" {
+		model = convertModel(override)
+	}
+
+	// KEY_SCOPES 限定了可用模型的 key 请求范围外的模型时拒绝
+	if !keyAllowsModel(apiKey, model) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("当前 APIKEY 无权使用模型 %s", model)})
 		return
 	}
 
-	token, err := requestToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取token"})
+	// 返回实际使用的上游模型，便于排查问题
+	setDiagHeader(c, "X-Upstream-Model", model)
+
+	// 测试模式下命中固定提示词时不请求上游，便于下游做可重复的集成测试
+	if canned, ok := cannedResponse(req.Messages); ok {
+		source := staticSource(canned)
+		if req.Stream {
+			if err := handleStreamResponse(c, source, model, &req, timing, stopRe); err != nil {
+				log.Printf("流式响应处理失败: %v", err)
+			}
+			return
+		}
+		result, _ := handleNonStreamResponse(source, stopRe)
+		c.JSON(http.StatusOK, buildFinalResponse(newCompletionMeta(model, &req), result))
+		return
+	}
+
+	marshalBody := func(model string) ([]byte, error) {
+		reqBody := buildUpstreamBody(model, content)
+		if config.ForwardSamplingParams {
+			info, _ := findUpstreamModel(model)
+			for k, v := range info.translateParams(samplingParams(&req)) {
+				reqBody[k] = v
+			}
+		}
+		return json.Marshal(reqBody)
+	}
+
+	if config.AutoRouteHealthy && modelBlocks.unhealthy(model) {
+		if alternative := healthyAlternative(model); alternative != "" && keyAllowsModel(apiKey, alternative) {
+			log.Printf("模型 %s 近期频繁被拦截, 改用 %s", model, alternative)
+			model = alternative
+			setDiagHeader(c, "X-Upstream-Model", model)
+		}
+	}
+
+	// 非流式请求优先命中响应缓存，按健康路由后实际请求的模型查找
+	var key string
+	// 缓存的响应不会推进上游会话，会话模式下不使用缓存
+	if !req.Stream && config.ResponseCacheTTL > 0 && c.GetHeader("X-DDG-Stop-Regex") == "" && !config.ConversationIDs {
+		key = cacheKey(&req, model)
+		if cached, ok := responseCache.get(key); ok {
+			setDiagHeader(c, "X-Cache", "HIT")
+			c.JSON(http.StatusOK, buildFinalResponse(newCompletionMeta(model, &req), completionResult{Content: cached, FinishReason: "stop"}))
+			return
+		}
+		setDiagHeader(c, "X-Cache", "MISS")
+	}
+
+	// 限流按最终选定的上游模型计算
+	if !modelLimiter.allow(model) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("模型 %s 请求过于频繁, 请稍后重试", model)})
 		return
 	}
 
-	upstreamReq, err := http.NewRequest("POST", "https://duckduckgo.com/duckchat/v1/chat", strings.NewReader(string(body)))
+	body, err := marshalBody(model)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("创建请求失败: %v", err)})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("请求体序列化失败: %v", err)})
 		return
 	}
 
-	for k, v := range config.FakeHeaders {
-		upstreamReq.Header.Set(k, v)
+	var resp *http.Response
+	// buffered 为 RELIABLE_STREAM 下已完整读取的上游响应
+	var buffered chunkSource
+	reliableStream := req.Stream && config.ReliableStream && !(config.DevMode && strings.EqualFold(c.GetHeader("X-DDG-Raw"), "true"))
+	var lastError error
+	// 客户端可通过 X-DDG-Max-Retries 与 X-DDG-Retry-Delay-Ms 为本次请求单独调整重试策略
+	maxAttempts := config.MaxRetryCount
+	if value, err := strconv.Atoi(c.GetHeader("X-DDG-Max-Retries")); err == nil {
+		maxAttempts = min(value, maxRetryOverride)
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	retryDelay := config.RetryDelay
+	if value, err := strconv.Atoi(c.GetHeader("X-DDG-Retry-Delay-Ms")); err == nil && value >= 0 {
+		retryDelay = min(time.Duration(value)*time.Millisecond, maxRetryDelayOverride)
+	}
+
+	opts := chatOptions{Timing: timing}
+	if config.ForwardAcceptLanguage {
+		opts.AcceptLanguage = c.GetHeader("Accept-Language")
+	}
+	if config.AutoAcceptLanguage && opts.AcceptLanguage == "" {
+		opts.AcceptLanguage = detectAcceptLanguage(req.Messages)
+	}
+	var conversationID string
+	if config.ConversationIDs {
+		conversationID, opts.VQD = resolveConversation(c)
+		c.Header("X-Conversation-Id", conversationID)
+		c.Set(conversationIDContextKey, conversationID)
 	}
-	upstreamReq.Header.Set("x-vqd-4", token)
-	upstreamReq.Header.Set("Content-Type", "application/json")
 
-	client := createHTTPClient(30 * time.Second)
+	// 客户端可通过 X-DDG-Timeout（秒）为整个请求设置总时限
+	requestTimeout := config.RequestTimeout
+	if value := c.GetHeader("X-DDG-Timeout"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			requestTimeout = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	ctx := c.Request.Context()
+	if requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
 
-	resp, err := client.Do(upstreamReq)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("请求失败: %v", err)})
+	var blockedProxy *url.URL
+	var fallbacks []string
+	for _, id := range config.FallbackModels {
+		if fallback := convertModel(id); fallback != model && keyAllowsModel(apiKey, fallback) {
+			fallbacks = append(fallbacks, fallback)
+		}
+	}
+	requestLogger := &attemptLogger{RequestID: c.GetString(requestIDContextKey)}
+	var retries int
+	// 一次尝试 = 获取 token + 一次对话请求，MAX_RETRY_COUNT 限制的是完整尝试的次数
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		logger := &attemptLogger{RequestID: requestLogger.RequestID, Attempt: attempt}
+		if attempt > 1 {
+			delay := adaptiveDelay(retryDelay)
+			// 上游 429 给出 Retry-After 时至少等待该时长，上限为 RETRY_AFTER_MAX，总时限仍由 ctx 控制
+			var upstreamErr *UpstreamError
+			if config.HonorRetryAfter && errors.As(lastError, &upstreamErr) {
+				delay = max(delay, min(upstreamErr.RetryAfter, config.RetryAfterMax))
+			}
+			logger.Printf("开始第 %d/%d 次尝试, 等待 %v", attempt, maxAttempts, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		opts.Proxy = upstreamProxies.pick(blockedProxy)
+		opts.Logger = logger
+		opts.Timeout = upstreamTimeout(model)
+		retries = attempt - 1
+		setDiagHeader(c, "X-Retry-Count", strconv.Itoa(retries))
+		resp, lastError = sendChatRequest(ctx, body, opts)
+		// RELIABLE_STREAM 下在重试循环内读完整个响应，中途断开同样计入失败并重试
+		if lastError == nil && reliableStream {
+			if buffered, lastError = bufferUpstreamChunks(resp); lastError != nil {
+				resp.Body.Close()
+				lastError = withStep(lastError, stepChat)
+			}
+		}
+		if lastError == nil {
+			saveConversation(apiKey, conversationID, resp.Header.Get("x-vqd-4"))
+			break
+		}
+		logger.Printf("尝试 %d/%d 失败: %v", attempt, maxAttempts, lastError)
+		// 会话 token 可能已失效，重试时改用新 token
+		opts.VQD = ""
+
+		var upstreamErr *UpstreamError
+		isUpstreamErr := errors.As(lastError, &upstreamErr)
+		// 模型不可用时改用下一个备用模型，不占用重试次数；备用模型同样受限流约束，超限的直接跳过
+		for isUpstreamErr && upstreamErr.ModelUnavailable() && len(fallbacks) > 0 && !modelLimiter.allow(fallbacks[0]) {
+			logger.Printf("备用模型 %s 请求过于频繁, 跳过", fallbacks[0])
+			fallbacks = fallbacks[1:]
+		}
+		if isUpstreamErr && upstreamErr.ModelUnavailable() && len(fallbacks) > 0 {
+			logger.Printf("模型 %s 不可用, 改用 %s", model, fallbacks[0])
+			model, fallbacks = fallbacks[0], fallbacks[1:]
+			if body, err = marshalBody(model); err != nil {
+				break
+			}
+			setDiagHeader(c, "X-Upstream-Model", model)
+			attempt--
+			continue
+		}
+		if isUpstreamErr && !upstreamErr.Retryable() {
+			break
+		}
+		// 被拦截的代理在紧接着的重试中不再使用
+		blockedProxy = nil
+		if isUpstreamErr && (upstreamErr.StatusCode == http.StatusTeapot || upstreamErr.StatusCode == http.StatusTooManyRequests) {
+			blockedProxy = opts.Proxy
+		}
+		if isUpstreamErr && upstreamErr.StatusCode == http.StatusTeapot {
+			modelBlocks.record(model)
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		requestLogger.Printf("请求超时, 上次错误: %v", lastError)
+		// 超时前已拿到明确的上游错误时优先返回该错误
+		var upstreamErr *UpstreamError
+		if errors.As(lastError, &upstreamErr) && upstreamErr.StatusCode != 0 {
+			c.JSON(upstreamErr.ClientStatus(), gin.H{"error": lastError.Error()})
+			return
+		}
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "请求超时"})
+		return
+	}
+
+	if lastError != nil {
+		requestLogger.Printf("请求最终失败: %v", lastError)
+		status := http.StatusInternalServerError
+		var upstreamErr *UpstreamError
+		if errors.As(lastError, &upstreamErr) {
+			status = upstreamErr.ClientStatus()
+			if upstreamErr.ModelUnavailable() {
+				c.JSON(status, gin.H{"error": fmt.Sprintf("模型 %s 暂不可用", model), "type": upstreamErr.Type})
+				return
+			}
+		}
+		c.JSON(status, gin.H{"error": lastError.Error()})
 		return
 	}
 	defer resp.Body.Close()
 
+	// 开发模式下可直接透传上游原始 SSE 数据
+	if config.DevMode && strings.EqualFold(c.GetHeader("X-DDG-Raw"), "true") {
+		if err := handleRawStreamResponse(c, resp); err != nil {
+			log.Printf("原始流透传失败: %v", err)
+		}
+		return
+	}
+
+	source := upstreamSource(resp)
+	if buffered != nil {
+		source = buffered
+	}
 	if req.Stream {
-		// 启用 SSE 流式响应
-		c.Writer.Header().Set("Content-Type", "text/event-stream")
-		c.Writer.Header().Set("Cache-Control", "no-cache")
-		c.Writer.Header().Set("Connection", "keep-alive")
+		// 部分模型流式输出不稳定，先在服务端完整读取再以 SSE 重放
+		if buffered == nil && isForceBufferModel(model) {
+			buffered, err := bufferUpstreamChunks(resp)
+			if err != nil {
+				log.Printf("读取响应失败: %v", err)
+				respondReadError(c, ctx, err)
+				return
+			}
+			source = buffered
+		}
 
-		flusher, ok := c.Writer.(http.Flusher)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		if err := handleStreamResponse(c, source, model, &req, timing, stopRe); err != nil {
+			log.Printf("流式响应处理失败: %v", err)
+			if !c.Writer.Written() {
+				respondReadError(c, ctx, err)
+			}
+		}
+		return
+	}
+
+	result, err := handleNonStreamResponse(source, stopRe)
+	if err != nil {
+		log.Printf("读取响应失败: %v", err)
+		if respondReadError(c, ctx, err) {
 			return
 		}
+	}
 
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("读取流式响应失败: %v", err)
-				}
-				break
+	if config.DetectRefusals && isRefusal(result.Content) {
+		result.FinishReason = "content_filter"
+		if config.RefusalAsError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "上游拒绝回答该请求", "type": "content_filter", "content": result.Content})
+			return
+		}
+	}
+
+	result.Content = postprocessText(result.Content) + truncationNotice(result.FinishReason, result.Truncated)
+	result.Retries = retries
+
+	// 缓存命中时固定返回 stop，因此只缓存正常结束的响应；
+	// 备用模型的回答按实际回答的模型缓存，不会在之后作为原模型的结果返回
+	if key != "" && err == nil && result.FinishReason == "stop" {
+		responseCache.set(cacheKey(&req, model), result.Content, config.ResponseCacheTTL)
+	}
+
+	// 返回完整 JSON 响应
+	timing.setHeaders(c, false)
+	response := buildFinalResponse(newCompletionMeta(model, &req), result)
+	// 开发模式下可附带实际发送给上游的提示词，便于排查消息拼接问题
+	if config.DevMode && strings.EqualFold(c.GetHeader("X-DDG-Include-Prompt"), "true") {
+		response["x_debug_prompt"] = content
+	}
+	if conversationID != "" {
+		response["conversation_id"] = conversationID
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// 请求头覆盖重试参数时的上限，避免单个请求长期占用上游
+const (
+	maxRetryOverride      = 10
+	maxRetryDelayOverride = 30 * time.Second
+)
+
+// respondReadError 处理读取上游响应体时的错误，已写出错误响应时返回 true
+func respondReadError(c *gin.Context, ctx context.Context, err error) bool {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "请求超时"})
+		return true
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		c.JSON(upstreamErr.ClientStatus(), gin.H{"error": err.Error()})
+		return true
+	}
+	return false
+}
+
+// isForceBufferModel 判断模型是否配置在 FORCE_BUFFER_MODELS 中
+func isForceBufferModel(model string) bool {
+	for _, id := range config.ForceBufferModels {
+		if info, ok := findModel(id); (ok && info.Upstream == model) || id == model {
+			return true
+		}
+	}
+	return false
+}
+
+// bindChatRequest 解析请求体，STRICT_JSON 开启时拒绝未知字段以便客户端发现拼写错误
+func bindChatRequest(c *gin.Context, req *ChatRequest) error {
+	if !config.StrictJSON {
+		return c.ShouldBindJSON(req)
+	}
+
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			field = strings.Trim(field, `"`)
+			return &paramError{Param: field, Message: fmt.Sprintf("请求体包含未知字段: %s", field)}
+		}
+		return err
+	}
+	return nil
+}
+
+// chatOptions 保存单个请求对上游调用的定制项
+type chatOptions struct {
+	// 非空时覆盖默认的 Accept-Language
+	AcceptLanguage string
+	// 非空时记录对话请求的开始时间
+	Timing *requestTiming
+	// 非空时 token 与对话请求都经由该代理发送，覆盖 PROXY_URL
+	Proxy *url.URL
+	// 为本次尝试的 token 与对话请求日志加上关联字段
+	Logger *attemptLogger
+	// 对话请求的超时，为 0 时使用 UPSTREAM_TIMEOUT
+	Timeout time.Duration
+	// 非空时直接使用该 token 延续上游会话，不再获取新 token
+	VQD string
+}
+
+// sendChatRequest 获取 token 并发送一次对话请求，非 200 响应以 UpstreamError 返回
+func sendChatRequest(ctx context.Context, body []byte, opts chatOptions) (*http.Response, error) {
+	if opts.Proxy != nil {
+		ctx = withProxy(ctx, opts.Proxy)
+	}
+	if opts.Logger != nil {
+		ctx = withAttemptLogger(ctx, opts.Logger)
+	}
+	token := opts.VQD
+	if token == "" {
+		var err error
+		if token, err = getToken(ctx); err != nil {
+			return nil, withStep(err, stepToken)
+		}
+	}
+
+	upstreamReq, err := buildUpstreamRequest(ctx, body, token, opts)
+	if err != nil {
+		return nil, err
+	}
+	debugLogRequest("上游请求", upstreamReq.Method, upstreamReq.URL.String(), upstreamReq.Header, body)
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = config.UpstreamTimeout
+	}
+	client := createHTTPClient(timeout)
+
+	if opts.Timing != nil {
+		opts.Timing.chatStart = time.Now()
+	}
+	resp, err := client.Do(upstreamReq)
+	if err != nil {
+		upstreamErr := newNetworkError(err)
+		upstreamErr.Step = stepChat
+		return nil, upstreamErr
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		upstreamErr := newUpstreamError(resp)
+		upstreamErr.Step = stepChat
+		// token 被拒绝时丢弃缓存，下次重新获取
+		if upstreamErr.StatusCode == http.StatusTeapot {
+			tokenCache.flush()
+		}
+		if adaptiveStatus(upstreamErr.StatusCode) {
+			upstreamBlocks.record()
+		}
+		return nil, upstreamErr
+	}
+	upstreamBlocks.success()
+	return resp, nil
+}
+
+// chunkSource 依次将上游数据块交给 emit，直到上游结束或出错
+type chunkSource func(emit func(chunk map[string]interface{}) error) error
+
+// upstreamSource 直接从上游响应体中逐块读取
+func upstreamSource(resp *http.Response) chunkSource {
+	return func(emit func(chunk map[string]interface{}) error) error {
+		return readUpstreamChunks(resp, emit)
+	}
+}
+
+// staticSource 以单个数据块返回固定文本
+func staticSource(text string) chunkSource {
+	return func(emit func(chunk map[string]interface{}) error) error {
+		return emit(map[string]interface{}{"message": text})
+	}
+}
+
+// bufferUpstreamChunks 读取完整的上游响应，返回可重放的数据源
+func bufferUpstreamChunks(resp *http.Response) (chunkSource, error) {
+	var chunks []map[string]interface{}
+	err := readUpstreamChunks(resp, func(chunk map[string]interface{}) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(emit func(chunk map[string]interface{}) error) error {
+		for _, chunk := range chunks {
+			if err := emit(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// readUpstreamChunks 逐行解析上游的 SSE 数据，遇到 [DONE] 或 EOF 时结束
+func readUpstreamChunks(resp *http.Response, emit func(chunk map[string]interface{}) error) error {
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return &UpstreamError{Type: "stream_error", Body: err.Error()}
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			// 解析响应中的 JSON 数据块
+			line = strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+			if line == "[DONE]" {
+				return nil
 			}
 
-			if strings.HasPrefix(line, "data: ") {
-				// 解析响应中的 JSON 数据块
-				line = strings.TrimPrefix(line, "data: ")
-				var chunk map[string]interface{}
-				if err := json.Unmarshal([]byte(line), &chunk); err != nil {
-					log.Printf("解析响应行失败: %v", err)
-					continue
+			var chunk map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+				log.Printf("解析响应行失败: %v", err)
+				continue
+			}
+			// encoding/json 会把被拆开的多字节字符和单独的代理项替换为 U+FFFD，
+			// message 改为按原始字节解码，交给 utf8Filter 拼接跨 chunk 的字符
+			var raw struct {
+				Message json.RawMessage `json:"message"`
+			}
+			if json.Unmarshal([]byte(line), &raw) == nil {
+				if msg, ok := decodeRawJSONString(raw.Message); ok {
+					chunk["message"] = msg
 				}
+			}
+			if err := emit(chunk); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-				// 检查 chunk 是否包含 message
-				if msg, exists := chunk["message"]; exists && msg != nil {
-					if msgStr, ok := msg.(string); ok {
-						response := map[string]interface{}{
-							"id":      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-							"object":  "chat.completion.chunk",
-							"created": time.Now().Unix(),
-							"model":   model,
-							"choices": []map[string]interface{}{
-								{
-									"index": 0,
-									"delta": map[string]string{
-										"content": msgStr,
-									},
-									"finish_reason": nil,
-								},
-							},
-						}
-						// 将响应格式化为 SSE 数据块
-						sseData, _ := json.Marshal(response)
-						sseMessage := fmt.Sprintf("data: %s\n\n", sseData)
-
-						// 发送数据并刷新缓冲区
-						_, writeErr := c.Writer.Write([]byte(sseMessage))
-						if writeErr != nil {
-							log.Printf("写入响应失败: %v", writeErr)
-							break
-						}
-						flusher.Flush()
-					} else {
-						log.Printf("chunk[message] 不是字符串: %v", msg)
-					}
+// chunkMessage 取出数据块中的 message 文本
+func chunkMessage(chunk map[string]interface{}) (string, bool) {
+	msg, exists := chunk["message"]
+	if !exists || msg == nil {
+		log.Println("chunk 中未包含 message 或 message 为 nil")
+		return "", false
+	}
+	msgStr, ok := msg.(string)
+	if !ok {
+		log.Printf("chunk[message] 不是字符串: %v", msg)
+	}
+	return msgStr, ok
+}
+
+// upstreamFinishReasons 将上游可能使用的结束标识映射为 OpenAI 的 finish_reason
+var upstreamFinishReasons = map[string]string{
+	"stop":           "stop",
+	"end_turn":       "stop",
+	"eos":            "stop",
+	"length":         "length",
+	"max_tokens":     "length",
+	"content_filter": "content_filter",
+	"content-filter": "content_filter",
+	"filtered":       "content_filter",
+	"moderation":     "content_filter",
+}
+
+// chunkFinishReason 读取数据块中上游提供的结束原因，未提供或无法识别时返回空字符串
+func chunkFinishReason(chunk map[string]interface{}) string {
+	for _, field := range []string{"finish_reason", "finishReason", "stop_reason"} {
+		if value, ok := chunk[field].(string); ok && value != "" {
+			return upstreamFinishReasons[strings.ToLower(value)]
+		}
+	}
+	return ""
+}
+
+// errStreamMaxDuration 用于在流式响应超过 STREAM_MAX_DURATION 时停止读取上游
+var errStreamMaxDuration = errors.New("stream max duration exceeded")
+
+// errSlowClient 表示客户端在 STREAM_WRITE_TIMEOUT 内未能读走数据块
+var errSlowClient = errors.New("客户端读取过慢, 已中止流式响应")
+
+func handleStreamResponse(c *gin.Context, source chunkSource, model string, req *ChatRequest, timing *requestTiming, stopRe *regexp.Regexp) error {
+	// 启用 SSE 流式响应
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return errors.New("Streaming not supported")
+	}
+
+	// 每个数据块同步写出并刷新，读取上游随之放缓；写入超时说明客户端跟不上，直接中止
+	controller := http.NewResponseController(c.Writer)
+
+	filters, stop := appendStopFilter(newStreamFilters(), stopRe)
+	meta := newCompletionMeta(model, req)
+	meta.ConversationID = c.GetString(conversationIDContextKey)
+	// 开启 STREAM_LIVE_USAGE 时累计已输出的内容，用于估算实时用量
+	var promptTokens int
+	var streamed tokenCounter
+	if config.StreamLiveUsage {
+		promptTokens = estimateTokens(prepareMessages(req.Messages, model))
+	}
+	// 按 OpenAI 的格式，只有第一个数据块的 delta 携带 role
+	var roleSent bool
+	writeChunk := func(delta map[string]string, finishReason interface{}) error {
+		// 首个数据块写出前设置耗时相关的响应头
+		if !c.Writer.Written() {
+			timing.setHeaders(c, true)
+		}
+		if config.FirstDeltaRole {
+			if !roleSent {
+				delta["role"] = "assistant"
+				roleSent = true
+			} else {
+				delete(delta, "role")
+			}
+		}
+		// 将响应格式化为 SSE 数据块
+		chunk := buildChunk(meta, delta, finishReason)
+		if config.StreamLiveUsage {
+			streamed.add(delta["content"])
+			completionTokens := streamed.tokens()
+			chunk["x_usage"] = map[string]int{
+				"prompt_tokens":     promptTokens,
+				"completion_tokens": completionTokens,
+				"total_tokens":      promptTokens + completionTokens,
+			}
+		}
+		sseData, _ := json.Marshal(chunk)
+		sseMessage := fmt.Sprintf("data: %s\n\n", sseData)
+
+		// 发送数据并刷新缓冲区
+		if config.StreamWriteTimeout > 0 {
+			controller.SetWriteDeadline(time.Now().Add(config.StreamWriteTimeout))
+		}
+		if _, err := c.Writer.Write([]byte(sseMessage)); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errSlowClient
+			}
+			return fmt.Errorf("写入响应失败: %v", err)
+		}
+		if err := controller.Flush(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errSlowClient
+			}
+			return fmt.Errorf("写入响应失败: %v", err)
+		}
+		return nil
+	}
+	// 开启拒答识别时记录已输出的内容，结束时据此决定 finish_reason
+	var assembled strings.Builder
+	// 配置了后处理命令时先缓冲全部内容，结束时处理后一次性输出
+	var held strings.Builder
+	// STREAM_COALESCE_MS 窗口内尚未输出的增量
+	var pending strings.Builder
+	var pendingSince time.Time
+	flushPending := func() error {
+		if pending.Len() == 0 {
+			return nil
+		}
+		content := pending.String()
+		pending.Reset()
+		pendingSince = time.Time{}
+		return writeChunk(map[string]string{"content": content}, nil)
+	}
+	// 上游暂无新数据时由定时器在窗口到期后输出积攒的增量，writeMu 保证定时器与读取循环串行写出
+	var writeMu sync.Mutex
+	var coalesceTimer *time.Timer
+	var coalesceErr error
+	var streamDone bool
+	onCoalesceTimer := func() {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if streamDone || pendingSince.IsZero() || coalesceErr != nil {
+			return
+		}
+		if wait := config.StreamCoalesce - time.Since(pendingSince); wait > 0 {
+			coalesceTimer.Reset(wait)
+			return
+		}
+		coalesceErr = flushPending()
+	}
+	// writeContent 只接收过滤链的输出，过滤器缓冲内容时输出为空，此时不写出空增量；
+	// 上游本身的空增量由 SKIP_EMPTY_DELTAS 决定是否转发
+	writeContent := func(content string) error {
+		if content == "" {
+			return nil
+		}
+		if config.DetectRefusals {
+			assembled.WriteString(content)
+		}
+		if config.PostprocessCmd != "" {
+			held.WriteString(content)
+			return nil
+		}
+		if config.StreamCoalesce > 0 {
+			pending.WriteString(content)
+			if pendingSince.IsZero() {
+				pendingSince = time.Now()
+				if coalesceTimer == nil {
+					coalesceTimer = time.AfterFunc(config.StreamCoalesce, onCoalesceTimer)
 				} else {
-					log.Println("chunk 中未包含 message 或 message 为 nil")
+					coalesceTimer.Reset(config.StreamCoalesce)
 				}
 			}
+			if time.Since(pendingSince) < config.StreamCoalesce && pending.Len() < config.StreamMaxBuffer {
+				return nil
+			}
+			return flushPending()
 		}
-	} else {
-		// 非流式响应，返回完整的 JSON
-		var fullResponse strings.Builder
-		reader := bufio.NewReader(resp.Body)
+		return writeChunk(map[string]string{"content": content}, nil)
+	}
 
-		for {
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				log.Printf("读取响应失败: %v", err)
-				break
+	// 部分客户端要求尽快收到首个数据块，且按惯例首块携带 role
+	if config.InitialRoleChunk {
+		if err := writeChunk(map[string]string{"role": "assistant", "content": ""}, nil); err != nil {
+			return err
+		}
+	}
+
+	var deadline time.Time
+	if config.StreamMaxDuration > 0 {
+		deadline = time.Now().Add(config.StreamMaxDuration)
+	}
+
+	finishReason := "stop"
+	truncated := false
+	err := source(func(chunk map[string]interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if coalesceErr != nil {
+			return coalesceErr
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errStreamMaxDuration
+		}
+		if reason := chunkFinishReason(chunk); reason != "" {
+			finishReason = reason
+		}
+		if msgStr, ok := chunkMessage(chunk); ok {
+			if msgStr == "" && !config.SkipEmptyDeltas {
+				return writeChunk(map[string]string{"content": ""}, nil)
+			}
+			if err := writeContent(pushFilters(filters, msgStr)); err != nil {
+				return err
+			}
+			if stop != nil && stop.stopped {
+				return errStopRegexMatched
+			}
+		}
+		return nil
+	})
+	// 读取结束后停止定时器，之后的写出只在当前 goroutine 中进行
+	writeMu.Lock()
+	streamDone = true
+	if coalesceTimer != nil {
+		coalesceTimer.Stop()
+	}
+	if err == nil {
+		err = coalesceErr
+	}
+	writeMu.Unlock()
+	if errors.Is(err, errStopRegexMatched) {
+		finishReason = "stop"
+		truncated = true
+		err = nil
+	}
+	if errors.Is(err, errStreamMaxDuration) {
+		log.Printf("流式响应超过 %v, 提前结束", config.StreamMaxDuration)
+		finishReason = "length"
+		err = nil
+	}
+	if err != nil {
+		flushPending()
+		// 已开始输出时状态码无法再修改，部分客户端只读取 SSE 数据，需要在流中告知错误
+		if config.StreamErrorAsChunk && c.Writer.Written() {
+			writeStreamError(c, err)
+		}
+		return err
+	}
+
+	// 结束时发送带 finish_reason 的终止块和 [DONE]
+	if err := writeContent(flushFilters(filters)); err != nil {
+		return err
+	}
+	if err := flushPending(); err != nil {
+		return err
+	}
+	if config.PostprocessCmd != "" {
+		if text := postprocessText(held.String()); text != "" {
+			if err := writeChunk(map[string]string{"content": text}, nil); err != nil {
+				return err
 			}
+		}
+	}
+	if notice := truncationNotice(finishReason, truncated); notice != "" {
+		if err := writeChunk(map[string]string{"content": notice}, nil); err != nil {
+			return err
+		}
+	}
+	if config.DetectRefusals && isRefusal(assembled.String()) {
+		finishReason = "content_filter"
+	}
+	if err := writeChunk(map[string]string{}, finishReason); err != nil {
+		return err
+	}
+	if _, err := c.Writer.Write([]byte("data: [DONE]\n\n")); err != nil {
+		return fmt.Errorf("写入响应失败: %v", err)
+	}
+	flusher.Flush()
+	return nil
+}
 
-			if strings.HasPrefix(line, "data: ") {
-				line = strings.TrimPrefix(line, "data: ")
-				line = strings.TrimSpace(line)
+// writeStreamError 以数据块形式写出 OpenAI 风格的错误对象
+func writeStreamError(c *gin.Context, err error) {
+	errType := "upstream_error"
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.Type != "" {
+		errType = upstreamErr.Type
+	}
 
-				if line == "[DONE]" {
-					break
-				}
+	data, _ := json.Marshal(gin.H{"error": gin.H{"message": err.Error(), "type": errType}})
+	fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+	c.Writer.Flush()
+}
 
-				var chunk map[string]interface{}
-				if err := json.Unmarshal([]byte(line), &chunk); err != nil {
-					log.Printf("解析响应行失败: %v", err)
-					continue
-				}
+// handleRawStreamResponse 不做任何转换，逐行转发上游的 SSE 数据
+func handleRawStreamResponse(c *gin.Context, resp *http.Response) error {
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Status(http.StatusOK)
 
-				if message, exists := chunk["message"]; exists {
-					if msgStr, ok := message.(string); ok {
-						fullResponse.WriteString(msgStr)
-					}
-				}
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		return errors.New("Streaming not supported")
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if _, writeErr := c.Writer.Write([]byte(line)); writeErr != nil {
+				return fmt.Errorf("写入响应失败: %v", writeErr)
 			}
+			flusher.Flush()
 		}
+		if err != nil {
+			if err != io.EOF {
+				return &UpstreamError{Type: "stream_error", Body: err.Error()}
+			}
+			return nil
+		}
+	}
+}
+
+// handleNonStreamResponse 读取完整的上游响应并拼接为一段文本，同时返回结束原因与推理内容的估算 token 数
+func handleNonStreamResponse(source chunkSource, stopRe *regexp.Regexp) (completionResult, error) {
+	var fullResponse strings.Builder
+	result := completionResult{FinishReason: "stop"}
+	err := source(func(chunk map[string]interface{}) error {
+		if reason := chunkFinishReason(chunk); reason != "" {
+			result.FinishReason = reason
+		}
+		if msgStr, ok := chunkMessage(chunk); ok {
+			fullResponse.WriteString(msgStr)
+		}
+		return nil
+	})
+	if err != nil {
+		result.Content = fullResponse.String()
+		return result, err
+	}
 
-		// 返回完整 JSON 响应
-		response := map[string]interface{}{
-			"id":      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-			"object":  "chat.completion",
-			"created": time.Now().Unix(),
-			"model":   model,
-			"usage": map[string]int{
-				"prompt_tokens":     0,
-				"completion_tokens": 0,
-				"total_tokens":      0,
-			},
-			"choices": []map[string]interface{}{
-				{
-					"message": map[string]string{
-						"role":    "assistant",
-						"content": fullResponse.String(),
-					},
-					"index": 0,
-				},
-			},
+	filters, stop := appendStopFilter(newStreamFilters(), stopRe)
+	result.Content = applyFilters(filters, fullResponse.String())
+	if stop != nil && stop.stopped {
+		result.FinishReason = "stop"
+		result.Truncated = true
+	}
+	result.ReasoningTokens = estimateTokens(reasoningText(filters))
+	return result, nil
+}
+
+// getToken 启用 token 池时从池中租用，否则优先使用缓存的 token，缓存失效时重新获取
+func getToken(ctx context.Context) (string, error) {
+	// token 池为空时直接获取，不等待后台补充
+	if upstreamTokenPool != nil {
+		if token, ok := upstreamTokenPool.lease(); ok {
+			return token, nil
 		}
+		return requestToken(ctx)
+	}
+	if config.TokenCacheTTL <= 0 {
+		return requestToken(ctx)
+	}
+	if token, ok := tokenCache.get(tokenCacheKey); ok {
+		return token, nil
+	}
+
+	release, err := acquireTokenFetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	// 等待名额期间其他请求可能已经获取并缓存了 token
+	if token, ok := tokenCache.get(tokenCacheKey); ok {
+		return token, nil
+	}
+
+	token, err := fetchToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	tokenCache.set(tokenCacheKey, token, config.TokenCacheTTL)
+	return token, nil
+}
 
-		c.JSON(http.StatusOK, response)
+// requestToken 在 MAX_CONCURRENT_TOKEN_FETCHES 的限制下获取一个新 token
+func requestToken(ctx context.Context) (string, error) {
+	release, err := acquireTokenFetch(ctx)
+	if err != nil {
+		return "", err
 	}
+	defer release()
+	return fetchToken(ctx)
 }
 
-func requestToken() (string, error) {
-	req, err := http.NewRequest("GET", "https://duckduckgo.com/duckchat/v1/status", nil)
+func fetchToken(ctx context.Context) (token string, err error) {
+	// 调用方取消或超时导致的失败不代表上游不可用，不计入 readyz 的判断
+	defer func() {
+		if err == nil || ctx.Err() == nil {
+			lastTokenFetch.record(err)
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://duckduckgo.com/duckchat/v1/status", nil)
 	if err != nil {
 		return "", fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -308,85 +1536,266 @@ func requestToken() (string, error) {
 
 	client := createHTTPClient(10 * time.Second)
 
-	log.Println("发送 token 请求")
+	logger := attemptLoggerFrom(ctx)
+	logger.Printf("发送 token 请求")
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("请求失败: %v", err)
+		return "", newNetworkError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		bodyString := string(bodyBytes)
-		log.Printf("requestToken: 非200响应: %d, 内容: %s\n", resp.StatusCode, bodyString)
-		return "", fmt.Errorf("非200响应: %d, 内容: %s", resp.StatusCode, bodyString)
+		upstreamErr := newUpstreamError(resp)
+		logger.Printf("requestToken: 非200响应: %d, 内容: %s", upstreamErr.StatusCode, upstreamErr.Body)
+		return "", upstreamErr
 	}
 
-	token := resp.Header.Get("x-vqd-4")
+	token = resp.Header.Get("x-vqd-4")
 	if token == "" {
 		return "", errors.New("响应中未包含x-vqd-4头")
 	}
+	// 截断或占位的 token 会导致对话请求 418，作为可重试错误返回以便重新获取
+	if !validVQD(token) {
+		logger.Printf("x-vqd-4 格式异常, 已丢弃: %q", token)
+		return "", &UpstreamError{Type: errTypeInvalidVQD, Body: fmt.Sprintf("x-vqd-4 格式异常: %q", token)}
+	}
 
 	// log.Printf("获取到的 token: %s\n", token)
 	return token, nil
 }
 
-func prepareMessages(messages []struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"`
-}) string {
+// vqdPattern 匹配形如 4-123456... 的 token，只允许字母、数字、- 与 _
+var vqdPattern = regexp.MustCompile(`^[0-9]+-[A-Za-z0-9_-]{16,}$`)
+
+// validVQD 检查 token 的长度与字符集，排除截断值和 ${...} 之类的模板占位符
+func validVQD(token string) bool {
+	return len(token) <= 512 && vqdPattern.MatchString(token)
+}
+
+// prepareMessages flattens the messages into the single prompt string the upstream expects;
+// system messages are handled according to the model's system_role setting
+func prepareMessages(messages []ChatMessage, model string) string {
 	var contentBuilder strings.Builder
+	info, _ := findUpstreamModel(model)
+
+	// The global conversation header always goes first, formatted like a converted system message
+	if config.ConversationHeader != "" {
+		contentBuilder.WriteString(fmt.Sprintf("user:%s;%s", config.ConversationHeader, config.PromptLineTerminator))
+	}
+
+	type flatMessage struct {
+		role    string
+		content string
+	}
+	var flattened []flatMessage
+
+	// In merge mode, system messages before the first user message are folded into it
+	mergeSystem := false
+	if info.SystemRole == systemRoleMerge {
+		for _, msg := range messages {
+			if msg.Role == "user" {
+				mergeSystem = true
+				break
+			}
+		}
+	}
+	var systemPrefix []string
 
 	for _, msg := range messages {
-		// Determine the role - 'system' becomes 'user'
+		// Determine the role - 'system' becomes 'user' unless the model keeps it
 		role := msg.Role
-		if role == "system" {
+		if role == "system" && info.SystemRole != systemRoleKeep {
 			role = "user"
 		}
+		// Keep the speaker identity in multi-participant chats
+		if msg.Name != "" {
+			role = fmt.Sprintf("%s(%s)", role, msg.Name)
+		}
 
-		// Process the content as string
-		contentStr := ""
-		switch v := msg.Content.(type) {
-		case string:
-			contentStr = v
-		case []interface{}:
-			for _, item := range v {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if text, exists := itemMap["text"].(string); exists {
-						contentStr += text
-					}
-				}
+		contentStr := messageText(msg)
+		if config.CompactWhitespace {
+			contentStr = compactWhitespace(contentStr)
+		}
+		if config.SerializeToolCalls && len(msg.ToolCalls) > 0 {
+			contentStr = appendToolCalls(contentStr, msg.ToolCalls)
+		}
+
+		if mergeSystem {
+			if msg.Role == "system" {
+				systemPrefix = append(systemPrefix, contentStr)
+				continue
 			}
-		default:
-			contentStr = fmt.Sprintf("%v", msg.Content)
+			if msg.Role == "user" {
+				contentStr = strings.Join(append(systemPrefix, contentStr), "\n")
+				mergeSystem = false
+			}
+		}
+
+		// Optionally merge into the previous message when the role repeats
+		if last := len(flattened) - 1; config.MergeConsecutive && last >= 0 && flattened[last].role == role {
+			flattened[last].content += "\n" + contentStr
+			continue
 		}
+		flattened = append(flattened, flatMessage{role: role, content: contentStr})
+	}
 
+	for _, msg := range flattened {
 		// Append the role and content to the builder
-		contentBuilder.WriteString(fmt.Sprintf("%s:%s;\r\n", role, contentStr))
+		contentBuilder.WriteString(fmt.Sprintf("%s:%s;%s", msg.role, msg.content, config.PromptLineTerminator))
 	}
 
+	// Drop the dangling separator after the last message so the prompt ends cleanly
+	if config.TrimTrailingSeparator {
+		return strings.TrimSuffix(contentBuilder.String(), ";"+config.PromptLineTerminator)
+	}
 	return contentBuilder.String()
 }
 
-func convertModel(inputModel string) string {
-	switch strings.ToLower(inputModel) {
-	case "claude-3-haiku":
-		return "claude-3-haiku-20240307"
-	case "llama-3.1-70b":
-		return "meta-llama/Meta-Llama-3.1-70B-Instruct-Turbo"
-	case "mixtral-8x7b":
-		return "mistralai/Mixtral-8x7B-Instruct-v0.1"
+// messageText extracts the text of a message, concatenating the text parts of array content.
+// A single content-part object is treated like a one-element array; numbers are formatted
+// without exponents (123, 0.5) and booleans become "true"/"false"
+func messageText(msg ChatMessage) string {
+	contentStr := ""
+	switch v := msg.Content.(type) {
+	case nil:
+	case string:
+		contentStr = v
+	case []interface{}:
+		for _, item := range v {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				if text, exists := itemMap["text"].(string); exists {
+					contentStr += text
+				}
+			}
+		}
+	case map[string]interface{}:
+		if text, exists := v["text"].(string); exists {
+			contentStr = text
+		}
+	case float64:
+		contentStr = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		contentStr = strconv.FormatBool(v)
 	default:
-		return "gpt-4o-mini"
+		contentStr = fmt.Sprintf("%v", msg.Content)
 	}
+	return contentStr
+}
+
+// compactWhitespace trims trailing whitespace from each line and collapses runs of blank lines
+// into a single blank line; lines inside ``` fenced code blocks are left untouched
+func compactWhitespace(text string) string {
+	lines := strings.Split(text, "\n")
+	compacted := make([]string, 0, len(lines))
+	inFence := false
+	blank := false
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		} else if inFence {
+			compacted = append(compacted, line)
+			continue
+		}
+
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			if blank || len(compacted) == 0 {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		compacted = append(compacted, line)
+	}
+	return strings.TrimRight(strings.Join(compacted, "\n"), "\n")
+}
+
+// appendToolCalls appends a readable summary of the tool calls to the message text
+func appendToolCalls(content string, calls []ToolCall) string {
+	lines := make([]string, 0, len(calls)+1)
+	if content != "" {
+		lines = append(lines, content)
+	}
+	for _, call := range calls {
+		lines = append(lines, fmt.Sprintf("[tool_call] %s(%s)", call.Function.Name, call.Function.Arguments))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func convertModel(inputModel string) string {
+	if info, ok := resolveModel(inputModel); ok {
+		return info.Upstream
+	}
+	return "gpt-4o-mini"
+}
+
+// timeoutMiddleware 为路由设置服务端超时，处理函数未写出响应时返回 504
+func timeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "请求超时"})
+		}
+	}
+}
+
+// defaultCORSAllowHeaders 包含客户端可能发送的标准头与全部 X-DDG-* 控制头
+var defaultCORSAllowHeaders = []string{
+	"Authorization", "Content-Type", "Accept", "Accept-Language",
+	"X-DDG-Model", "X-DDG-Timeout", "X-DDG-No-SSE", "X-DDG-Raw",
+	"X-DDG-Max-Retries", "X-DDG-Retry-Delay-Ms", "X-DDG-Stop-Regex", "X-DDG-Include-Prompt", "X-Request-ID",
+	"X-Conversation-Id",
 }
 
 func corsMiddleware() gin.HandlerFunc {
+	configuredHeaders := len(config.CORSAllowHeaders) > 0
+	headers := config.CORSAllowHeaders
+	if !configuredHeaders {
+		headers = defaultCORSAllowHeaders
+	}
+	allowHeaders := strings.Join(headers, ", ")
+	allowedOrigins := make(map[string]bool, len(config.CORSOrigins))
+	for _, origin := range config.CORSOrigins {
+		allowedOrigins[strings.TrimSuffix(origin, "/")] = true
+	}
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "*")
+		// 配置了 CORS_ORIGINS 时响应随 Origin 变化，无论是否命中都需要告知缓存
+		if len(allowedOrigins) > 0 {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		// 携带凭据的跨域请求不接受 *，对配置过的来源回显具体 Origin
+		credentialed := allowedOrigins[c.GetHeader("Origin")]
+		if credentialed {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", c.GetHeader("Origin"))
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		// 浏览器中的脚本只能读取显式暴露的响应头
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Conversation-Id")
+		// SDK 会发送 x-stainless-*、openai-* 等不在列表中的头，未配置 CORS_ALLOW_HEADERS 时对普通跨域请求回显预检所请求的头
+		if requested := c.GetHeader("Access-Control-Request-Headers"); requested != "" && !configuredHeaders && !credentialed {
+			c.Writer.Header().Set("Access-Control-Allow-Headers", requested)
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		} else {
+			c.Writer.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+		}
 		if c.Request.Method == http.MethodOptions {
+			if config.CORSMaxAge > 0 {
+				c.Writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.CORSMaxAge))
+			}
 			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
@@ -410,25 +1819,49 @@ func getIntEnv(key string, fallback int) int {
 	return fallback
 }
 
+func getBoolEnv(key string, fallback bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "1", "true", "yes", "on":
+			return true
+		case "0", "false", "no", "off":
+			return false
+		}
+	}
+	return fallback
+}
+
+// getListEnv 读取逗号分隔的列表，忽略空项
+func getListEnv(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEscapedEnv 读取字符串配置并解析其中的 Go 转义序列，便于配置不可见字符
+func getEscapedEnv(key, fallback string) string {
+	value := getEnv(key, fallback)
+	if unquoted, err := strconv.Unquote(`"` + value + `"`); err == nil {
+		return unquoted
+	}
+	return value
+}
+
 func getDurationEnv(key string, fallback int) time.Duration {
 	return time.Duration(getIntEnv(key, fallback)) * time.Millisecond
 }
 
 func createHTTPClient(timeout time.Duration) *http.Client {
-	client := &http.Client{
-		Timeout: timeout,
-	}
-	
-	if config.ProxyURL != "" {
-		proxyURL, err := url.Parse(config.ProxyURL)
-		if err != nil {
-			log.Printf("代理URL解析失败: %v", err)
-			return client
-		}
-		client.Transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: getUpstreamTransport(),
 	}
-	
-	return client
 }
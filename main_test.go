@@ -0,0 +1,1618 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// withConfig 在测试期间修改全局配置，结束时恢复
+func withConfig(t *testing.T, update func(c *Config)) {
+	t.Helper()
+	saved := config
+	update(&config)
+	t.Cleanup(func() { config = saved })
+}
+
+// withUpstream 将所有发往上游的请求转到 handler，返回的 server 可用于统计请求
+func withUpstream(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	getUpstreamTransport()
+	saved := upstreamTransport
+	upstreamTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	t.Cleanup(func() {
+		upstreamTransport.CloseIdleConnections()
+		upstreamTransport = saved
+	})
+	tokenCache.flush()
+	return server
+}
+
+const testVQD = "4-abcdefghijklmnopqrstuvwxyz"
+
+// scriptedUpstream 按顺序返回 status 与 chat 的状态码，用完后返回 200
+type scriptedUpstream struct {
+	status []int
+	chat   []int
+	// statusCalls、chatCalls 记录实际收到的请求数
+	statusCalls atomic.Int32
+	chatCalls   atomic.Int32
+}
+
+func (s *scriptedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/duckchat/v1/status":
+		n := int(s.statusCalls.Add(1))
+		if n <= len(s.status) && s.status[n-1] != http.StatusOK {
+			w.WriteHeader(s.status[n-1])
+			return
+		}
+		w.Header().Set("x-vqd-4", testVQD)
+		w.WriteHeader(http.StatusOK)
+	case "/duckchat/v1/chat":
+		n := int(s.chatCalls.Add(1))
+		if n <= len(s.chat) && s.chat[n-1] != http.StatusOK {
+			w.WriteHeader(s.chat[n-1])
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"message\":\"ok\"}\n\ndata: [DONE]\n\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func postCompletion(t *testing.T, handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return postCompletionWithHeaders(t, handler, body, nil)
+}
+
+// postCompletionWithHeaders 与 postCompletion 相同，额外设置请求头
+func postCompletionWithHeaders(t *testing.T, handler gin.HandlerFunc, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := gin.New()
+	r.POST("/v1/chat/completions", handler)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// messageSource 依次产出给定的 message 数据块，模拟上游的流式响应
+func messageSource(messages ...string) chunkSource {
+	return func(emit func(chunk map[string]interface{}) error) error {
+		for _, message := range messages {
+			if err := emit(map[string]interface{}{"message": message}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// runStream 用 handleStreamResponse 输出 source，返回解析后的 SSE 数据块（不含 [DONE]）与原始响应
+func runStream(t *testing.T, source chunkSource, req *ChatRequest) ([]map[string]interface{}, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	if req == nil {
+		req = &ChatRequest{Model: "gpt-4o-mini", Stream: true}
+	}
+	if err := handleStreamResponse(c, source, "gpt-4o-mini", req, &requestTiming{start: time.Now()}, nil); err != nil {
+		t.Logf("handleStreamResponse: %v", err)
+	}
+
+	var chunks []map[string]interface{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("无效的数据块 %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, w
+}
+
+// streamedContent 拼接所有数据块的 content
+func streamedContent(chunks []map[string]interface{}) string {
+	var content strings.Builder
+	for _, chunk := range chunks {
+		text, _ := chunkContent(chunk)
+		content.WriteString(text)
+	}
+	return content.String()
+}
+
+// chunkFinish 返回流式数据块的 finish_reason
+func chunkFinish(chunk map[string]interface{}) interface{} {
+	choices, _ := chunk["choices"].([]interface{})
+	if len(choices) == 0 {
+		return nil
+	}
+	return choices[0].(map[string]interface{})["finish_reason"]
+}
+
+// chunkContent 返回流式数据块 delta 中的 content 及其是否存在
+func chunkContent(chunk map[string]interface{}) (string, bool) {
+	choices, _ := chunk["choices"].([]interface{})
+	if len(choices) == 0 {
+		return "", false
+	}
+	delta, _ := choices[0].(map[string]interface{})["delta"].(map[string]interface{})
+	content, ok := delta["content"].(string)
+	return content, ok
+}
+
+func TestHandleCompletionAttemptCounting(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxRetries  int
+		status      []int
+		chat        []int
+		wantCode    int
+		wantRetries string
+		// wantStatus、wantChat 为上游实际收到的请求数
+		wantStatus int32
+		wantChat   int32
+	}{
+		{
+			name:       "token 失败与对话失败各计一次尝试",
+			maxRetries: 3,
+			status:     []int{http.StatusInternalServerError},
+			chat:       []int{http.StatusBadGateway},
+			wantCode:   http.StatusOK, wantRetries: "2",
+			wantStatus: 3, wantChat: 2,
+		},
+		{
+			name:       "混合失败耗尽重试次数",
+			maxRetries: 2,
+			status:     []int{http.StatusInternalServerError},
+			chat:       []int{http.StatusBadGateway},
+			wantCode:   http.StatusBadGateway, wantRetries: "1",
+			wantStatus: 2, wantChat: 1,
+		},
+		{
+			name:       "不可重试的错误只尝试一次",
+			maxRetries: 3,
+			chat:       []int{http.StatusBadRequest},
+			wantCode:   http.StatusBadGateway, wantRetries: "0",
+			wantStatus: 1, wantChat: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MaxRetryCount = tt.maxRetries
+				c.RetryDelay = 0
+				c.ExposeDiagHeaders = true
+				c.TokenCacheTTL = 0
+				c.ResponseCacheTTL = 0
+			})
+			upstream := &scriptedUpstream{status: tt.status, chat: tt.chat}
+			withUpstream(t, upstream)
+
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if got := w.Header().Get("X-Retry-Count"); got != tt.wantRetries {
+				t.Errorf("X-Retry-Count = %q, want %q", got, tt.wantRetries)
+			}
+			if got := upstream.statusCalls.Load(); got != tt.wantStatus {
+				t.Errorf("token 请求 %d 次, want %d", got, tt.wantStatus)
+			}
+			if got := upstream.chatCalls.Load(); got != tt.wantChat {
+				t.Errorf("对话请求 %d 次, want %d", got, tt.wantChat)
+			}
+		})
+	}
+}
+
+func TestUpstreamModelHeader(t *testing.T) {
+	tests := []struct {
+		model  string
+		expose bool
+	}{
+		{"gpt-4o-mini", true},
+		{"claude-3-haiku", true},
+		{"GPT-4o", true},
+		{"openai/llama-3.1-70b", true},
+		{"mixtral-8x7b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ExposeDiagHeaders = tt.expose
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &modelUpstream{})
+			w := postCompletion(t, handleCompletion, `{"model":"`+tt.model+`","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			want := ""
+			if tt.expose {
+				want = convertModel(tt.model)
+			}
+			if got := w.Header().Get("X-Upstream-Model"); got != want {
+				t.Errorf("X-Upstream-Model = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		strict    bool
+		body      string
+		want      int
+		wantParam string
+	}{
+		{"默认忽略未知字段", false, `{"model":"gpt-4o-mini","temperatur":1,"messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, ""},
+		{"严格模式拒绝未知字段", true, `{"model":"gpt-4o-mini","temperatur":1,"messages":[{"role":"user","content":"hi"}]}`, http.StatusBadRequest, "temperatur"},
+		{"严格模式接受已知字段", true, `{"model":"gpt-4o-mini","temperature":1,"messages":[{"role":"user","content":"hi"}]}`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StrictJSON = tt.strict
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &scriptedUpstream{})
+			w := postCompletion(t, handleCompletion, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.wantParam == "" {
+				return
+			}
+			var resp struct {
+				Error struct {
+					Message string `json:"message"`
+					Param   string `json:"param"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的错误响应: %v", err)
+			}
+			if resp.Error.Param != tt.wantParam || !strings.Contains(resp.Error.Message, tt.wantParam) {
+				t.Errorf("error = %+v, want param %q", resp.Error, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		handler gin.HandlerFunc
+		want    int
+	}{
+		{"未超时", time.Second, func(c *gin.Context) { c.Status(http.StatusOK) }, http.StatusOK},
+		{"处理函数未写出响应", 20 * time.Millisecond, func(c *gin.Context) { <-c.Request.Context().Done() }, http.StatusGatewayTimeout},
+		{"超时为 0 时不限制", 0, func(c *gin.Context) {
+			if _, ok := c.Request.Context().Deadline(); ok {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.Status(http.StatusOK)
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", timeoutMiddleware(tt.timeout), tt.handler)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletionUpstreamTimeout(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ResponseCacheTTL = 0
+		c.RetryDelay = 0
+	})
+	release := make(chan struct{})
+	withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/duckchat/v1/status" {
+			w.Header().Set("x-vqd-4", testVQD)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(func() { close(release) })
+	r := gin.New()
+	r.POST("/v1/chat/completions", timeoutMiddleware(100*time.Millisecond), handleCompletion)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d, body = %s", w.Code, http.StatusGatewayTimeout, w.Body.String())
+	}
+}
+
+func TestRawPassthrough(t *testing.T) {
+	const raw = "data: {\"role\":\"assistant\",\"message\":\"\\u4f60\\u597d \",\"created\":1,\"model\":\"gpt-4o-mini\"}\n\n" +
+		": keep-alive\n\n" +
+		"data: {\"message\":\"world\",\"extra\":[1,2]}\n\n" +
+		"data: [DONE]\n\n"
+	tests := []struct {
+		name    string
+		devMode bool
+		header  string
+		wantRaw bool
+	}{
+		{"默认不透传", false, "true", false},
+		{"开发模式未带请求头", true, "", false},
+		{"开发模式透传", true, "true", true},
+		{"请求头不区分大小写", true, "TRUE", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.DevMode = tt.devMode
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/duckchat/v1/status" {
+					w.Header().Set("x-vqd-4", testVQD)
+					return
+				}
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte(raw))
+			}))
+
+			r := gin.New()
+			r.POST("/v1/chat/completions", handleCompletion)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("X-DDG-Raw", tt.header)
+			}
+			r.ServeHTTP(w, req)
+
+			if got := w.Body.String(); (got == raw) != tt.wantRaw {
+				t.Errorf("body = %q, raw passthrough = %v, want %v", got, got == raw, tt.wantRaw)
+			}
+			if !tt.wantRaw && !strings.Contains(w.Body.String(), "chat.completion.chunk") {
+				t.Errorf("body = %q, want OpenAI chunks", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesConversationHeader(t *testing.T) {
+	messages := []ChatMessage{{Role: "user", Content: "hi"}}
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"默认不注入", "", "user:hi"},
+		{"CONVERSATION_HEADER 位于最前", "只用中文回答", "user:只用中文回答;\r\nuser:hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ConversationHeader = tt.header })
+			if got := prepareMessages(messages, "gpt-4o-mini"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesMergeConsecutive(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: "user", Content: "a"},
+		{Role: "user", Content: "b"},
+		{Role: "assistant", Content: "c"},
+		{Role: "user", Content: "d"},
+	}
+	tests := []struct {
+		name  string
+		merge bool
+		want  string
+	}{
+		{"默认不合并", false, "user:a;\r\nuser:b;\r\nassistant:c;\r\nuser:d"},
+		{"MERGE_CONSECUTIVE 合并相邻同角色消息", true, "user:a\nb;\r\nassistant:c;\r\nuser:d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.MergeConsecutive = tt.merge })
+			if got := prepareMessages(messages, "gpt-4o-mini"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		header  string
+		// wantChat 为上游收到的对话请求数
+		wantChat int32
+	}{
+		{"默认不限制总时长", 0, "", 4},
+		{"REQUEST_TIMEOUT 限制总时长", 300 * time.Millisecond, "", 2},
+		{"X-DDG-Timeout 覆盖", time.Minute, "0.3", 2},
+		{"无效的 X-DDG-Timeout 被忽略", 300 * time.Millisecond, "abc", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MaxRetryCount = 4
+				c.RetryDelay = 200 * time.Millisecond
+				c.RequestTimeout = tt.timeout
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+				c.AdaptiveBlocking = false
+			})
+			upstream := &scriptedUpstream{chat: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}}
+			withUpstream(t, upstream)
+
+			headers := map[string]string{}
+			if tt.header != "" {
+				headers["X-DDG-Timeout"] = tt.header
+			}
+			w := postCompletionWithHeaders(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`, headers)
+			// 超时前已拿到上游错误时返回该错误
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, http.StatusBadGateway, w.Body.String())
+			}
+			if got := upstream.chatCalls.Load(); got != tt.wantChat {
+				t.Errorf("对话请求 %d 次, want %d", got, tt.wantChat)
+			}
+		})
+	}
+}
+
+func TestNoSSEDowngrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantJSON bool
+	}{
+		{"默认保持流式", "", false},
+		{"X-DDG-No-SSE 降级为 JSON", "1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ResponseCacheTTL = 0 })
+			withUpstream(t, &scriptedUpstream{})
+			headers := map[string]string{}
+			if tt.header != "" {
+				headers["X-DDG-No-SSE"] = tt.header
+			}
+			w := postCompletionWithHeaders(t, handleCompletion, `{"model":"gpt-4o-mini","stream":true,"messages":[{"role":"user","content":"hi"}]}`, headers)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			contentType := w.Header().Get("Content-Type")
+			if got := strings.HasPrefix(contentType, "application/json"); got != tt.wantJSON {
+				t.Errorf("Content-Type = %q, want JSON = %v", contentType, tt.wantJSON)
+			}
+			if !tt.wantJSON {
+				return
+			}
+			var resp struct {
+				Object  string `json:"object"`
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的 JSON 响应: %v, body = %s", err, w.Body.String())
+			}
+			if resp.Object != "chat.completion" || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "ok" {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+}
+
+func TestAutoUpgradeModel(t *testing.T) {
+	long := strings.Repeat("a", 400)
+	tests := []struct {
+		name    string
+		upgrade string
+		content string
+		want    string
+	}{
+		{"默认不切换", "", long, "gpt-4o-mini"},
+		{"未超过阈值", "llama-3.1-70b", "hi", "gpt-4o-mini"},
+		{"超过阈值切换", "llama-3.1-70b", long, convertModel("llama-3.1-70b")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AutoUpgradeModel = tt.upgrade
+				c.AutoUpgradeThreshold = 50
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &modelUpstream{})
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"`+tt.content+`"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Model   string `json:"model"`
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的 JSON 响应: %v", err)
+			}
+			if resp.Model != tt.want || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != tt.want {
+				t.Errorf("model = %q, upstream model = %+v, want %q", resp.Model, resp.Choices, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// wantStatus 为两次请求后上游收到的 token 请求数
+		wantStatus int32
+	}{
+		{"默认每次重新获取", 0, 2},
+		{"TOKEN_CACHE_TTL 内复用", time.Minute, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.TokenCacheTTL = tt.ttl
+				c.ResponseCacheTTL = 0
+			})
+			upstream := &scriptedUpstream{}
+			withUpstream(t, upstream)
+			t.Cleanup(func() { tokenCache.flush() })
+			for i := 0; i < 2; i++ {
+				if w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+					t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+				}
+			}
+			if got := upstream.statusCalls.Load(); got != tt.wantStatus {
+				t.Errorf("token 请求 %d 次, want %d", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestModelOverrideHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  bool
+		header string
+		want   string
+	}{
+		{"默认忽略请求头", false, "claude-3-haiku", "gpt-4o-mini"},
+		{"ALLOW_MODEL_OVERRIDE 使用请求头", true, "claude-3-haiku", "claude-3-haiku-20240307"},
+		{"未带请求头", true, "", "gpt-4o-mini"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AllowModelOverride = tt.allow
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &modelUpstream{})
+			headers := map[string]string{}
+			if tt.header != "" {
+				headers["X-DDG-Model"] = tt.header
+			}
+			w := postCompletionWithHeaders(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`, headers)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), `"content":"`+tt.want+`"`) {
+				t.Errorf("body = %s, want upstream model %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestIsForceBufferModel(t *testing.T) {
+	tests := []struct {
+		name   string
+		models []string
+		model  string
+		want   bool
+	}{
+		{"默认不缓冲", nil, "gpt-4o-mini", false},
+		{"目录 id", []string{"claude-3-haiku"}, "claude-3-haiku-20240307", true},
+		{"上游 id", []string{"claude-3-haiku-20240307"}, "claude-3-haiku-20240307", true},
+		{"未列出的模型", []string{"claude-3-haiku"}, "gpt-4o-mini", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForceBufferModels = tt.models })
+			if got := isForceBufferModel(tt.model); got != tt.want {
+				t.Errorf("isForceBufferModel(%q) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForceBufferReplaysSSE(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ForceBufferModels = []string{"gpt-4o-mini"}
+		c.ResponseCacheTTL = 0
+	})
+	withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/duckchat/v1/status" {
+			w.Header().Set("x-vqd-4", testVQD)
+			return
+		}
+		w.Write([]byte("data: {\"message\":\"hel\"}\n\ndata: {\"message\":\"lo\"}\n\ndata: [DONE]\n\n"))
+	}))
+	w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Content-Type = %q, want text/event-stream", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), `"content":"hel"`) || !strings.Contains(w.Body.String(), `"content":"lo"`) || !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		want    string
+		wantErr bool
+	}{
+		{"默认忽略 X-Forwarded-For", nil, "192.0.2.1", false},
+		{"信任的代理", []string{"192.0.2.0/24"}, "203.0.113.9", false},
+		{"不在信任范围内的代理", []string{"10.0.0.0/8"}, "192.0.2.1", false},
+		{"无效配置", []string{"not-an-ip"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.TrustedProxies = tt.proxies })
+			r, err := newRouter()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newRouter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			r.GET("/client-ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/client-ip", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			r.ServeHTTP(w, req)
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamErrorAsChunk(t *testing.T) {
+	failing := func(emit func(chunk map[string]interface{}) error) error {
+		if err := emit(map[string]interface{}{"message": "partial"}); err != nil {
+			return err
+		}
+		return &UpstreamError{Type: errTypeNetwork, Body: "connection reset"}
+	}
+	tests := []struct {
+		name      string
+		enabled   bool
+		wantError bool
+	}{
+		{"默认不输出错误块", false, false},
+		{"STREAM_ERROR_AS_CHUNK 输出错误块", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.StreamErrorAsChunk = tt.enabled })
+			chunks, _ := runStream(t, failing, nil)
+			if len(chunks) == 0 {
+				t.Fatal("没有输出任何数据块")
+			}
+			last, _ := chunks[len(chunks)-1]["error"].(map[string]interface{})
+			if (last != nil) != tt.wantError {
+				t.Fatalf("最后一个数据块 = %v, want error chunk %v", chunks[len(chunks)-1], tt.wantError)
+			}
+			if tt.wantError && (last["type"] != errTypeNetwork || !strings.Contains(last["message"].(string), "connection reset")) {
+				t.Errorf("error = %v", last)
+			}
+		})
+	}
+}
+
+func TestChunkFinishReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk map[string]interface{}
+		want  string
+	}{
+		{"未提供", map[string]interface{}{"message": "hi"}, ""},
+		{"stop", map[string]interface{}{"finish_reason": "stop"}, "stop"},
+		{"驼峰字段与大小写", map[string]interface{}{"finishReason": "MAX_TOKENS"}, "length"},
+		{"stop_reason", map[string]interface{}{"stop_reason": "moderation"}, "content_filter"},
+		{"无法识别", map[string]interface{}{"finish_reason": "unknown"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkFinishReason(tt.chunk); got != tt.want {
+				t.Errorf("chunkFinishReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamFinishReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []map[string]interface{}
+		want   string
+	}{
+		{"默认 stop", []map[string]interface{}{{"message": "hi"}}, "stop"},
+		{"使用上游提供的结束原因", []map[string]interface{}{{"message": "hi"}, {"message": "", "finish_reason": "length"}}, "length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := func(emit func(chunk map[string]interface{}) error) error {
+				for _, chunk := range tt.chunks {
+					if err := emit(chunk); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			chunks, _ := runStream(t, source, nil)
+			if got := chunkFinish(chunks[len(chunks)-1]); got != tt.want {
+				t.Errorf("finish_reason = %v, want %q", got, tt.want)
+			}
+
+			result, err := handleNonStreamResponse(source, nil)
+			if err != nil || result.FinishReason != tt.want {
+				t.Errorf("handleNonStreamResponse() finish_reason = %q, %v; want %q", result.FinishReason, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryOverrideHeaders(t *testing.T) {
+	failures := make([]int, 20)
+	for i := range failures {
+		failures[i] = http.StatusBadGateway
+	}
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantChat int32
+	}{
+		{"默认使用 MAX_RETRY_COUNT", nil, 3},
+		{"X-DDG-Max-Retries 减少尝试", map[string]string{"X-DDG-Max-Retries": "1"}, 1},
+		{"X-DDG-Max-Retries 不超过上限", map[string]string{"X-DDG-Max-Retries": "50"}, maxRetryOverride},
+		{"无效值被忽略", map[string]string{"X-DDG-Max-Retries": "abc"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MaxRetryCount = 3
+				// 默认间隔足够长，只有 X-DDG-Retry-Delay-Ms 生效时测试才能及时结束
+				c.RetryDelay = time.Minute
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+				c.AdaptiveBlocking = false
+			})
+			upstream := &scriptedUpstream{chat: failures}
+			withUpstream(t, upstream)
+			headers := map[string]string{"X-DDG-Retry-Delay-Ms": "0"}
+			for k, v := range tt.headers {
+				headers[k] = v
+			}
+			w := postCompletionWithHeaders(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`, headers)
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+			}
+			if got := upstream.chatCalls.Load(); got != tt.wantChat {
+				t.Errorf("对话请求 %d 次, want %d", got, tt.wantChat)
+			}
+		})
+	}
+}
+
+func TestSkipEmptyDeltas(t *testing.T) {
+	tests := []struct {
+		name      string
+		skip      bool
+		wantEmpty int
+	}{
+		{"默认转发空增量", false, 2},
+		{"SKIP_EMPTY_DELTAS 跳过空增量", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.SkipEmptyDeltas = tt.skip
+				c.InitialRoleChunk = false
+			})
+			chunks, _ := runStream(t, messageSource("a", "", " ", "", "b"), nil)
+			empty := 0
+			for _, chunk := range chunks {
+				if text, ok := chunkContent(chunk); ok && text == "" {
+					empty++
+				}
+			}
+			if empty != tt.wantEmpty {
+				t.Errorf("空增量 %d 个, want %d", empty, tt.wantEmpty)
+			}
+			// 只包含空白的增量始终保留
+			if got := streamedContent(chunks); got != "a b" {
+				t.Errorf("content = %q, want %q", got, "a b")
+			}
+		})
+	}
+}
+
+func TestStreamMaxDuration(t *testing.T) {
+	// 上游每 20ms 输出一块，不会触发空闲超时，但总时长远超上限
+	slowSource := func(emit func(chunk map[string]interface{}) error) error {
+		for i := 0; i < 10; i++ {
+			if err := emit(map[string]interface{}{"message": "x"}); err != nil {
+				return err
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil
+	}
+	tests := []struct {
+		name        string
+		maxDuration time.Duration
+		wantFinish  string
+		wantContent string
+	}{
+		{"默认不限制时长", 0, "stop", "xxxxxxxxxx"},
+		{"超过 STREAM_MAX_DURATION 以 length 结束", 50 * time.Millisecond, "length", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StreamMaxDuration = tt.maxDuration
+			})
+			chunks, _ := runStream(t, slowSource, nil)
+			if len(chunks) == 0 {
+				t.Fatal("没有收到数据块")
+			}
+			if got := chunkFinish(chunks[len(chunks)-1]); got != tt.wantFinish {
+				t.Errorf("finish_reason = %v, want %s", got, tt.wantFinish)
+			}
+			content := streamedContent(chunks)
+			if tt.wantContent != "" && content != tt.wantContent {
+				t.Errorf("content = %q, want %q", content, tt.wantContent)
+			}
+			if tt.wantContent == "" && len(content) >= 10 {
+				t.Errorf("content = %q, 超时后应停止读取上游", content)
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesName(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []ChatMessage
+		want     string
+	}{
+		{"没有 name 时保持原格式", []ChatMessage{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}}, "user:hi;\r\nassistant:hello"},
+		{"name 输出为 role(name)", []ChatMessage{
+			{Role: "user", Name: "alice", Content: "hi"},
+			{Role: "user", Name: "bob", Content: "hey"},
+			{Role: "assistant", Content: "hello"},
+		}, "user(alice):hi;\r\nuser(bob):hey;\r\nassistant:hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prepareMessages(tt.messages, "gpt-4o-mini"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncludePromptHeader(t *testing.T) {
+	const body = `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name    string
+		devMode bool
+		header  string
+		want    interface{}
+	}{
+		{"默认不返回", true, "", nil},
+		{"开发模式下按请求头返回", true, "true", "user:hi"},
+		{"非开发模式忽略请求头", false, "true", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.DevMode = tt.devMode
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &scriptedUpstream{})
+			headers := map[string]string{}
+			if tt.header != "" {
+				headers["X-DDG-Include-Prompt"] = tt.header
+			}
+			w := postCompletionWithHeaders(t, handleCompletion, body, headers)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var resp map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的响应: %v", err)
+			}
+			if got := resp["x_debug_prompt"]; got != tt.want {
+				t.Errorf("x_debug_prompt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesSystemRole(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "hi"},
+	}
+	tests := []struct {
+		name       string
+		systemRole string
+		want       string
+	}{
+		{"默认转为 user", "", "user:be brief;\r\nuser:hi"},
+		{"keep 保留 system", systemRoleKeep, "system:be brief;\r\nuser:hi"},
+		{"merge 并入第一条 user 消息", systemRoleMerge, "user:be brief\nhi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := modelCatalog
+			t.Cleanup(func() { modelCatalog = saved })
+			modelCatalog = []ModelInfo{{ID: "test-model", Upstream: "test-upstream", SystemRole: tt.systemRole}}
+			if got := prepareMessages(messages, "test-upstream"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamCoalesce(t *testing.T) {
+	deltas := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	tests := []struct {
+		name      string
+		coalesce  time.Duration
+		wantFewer bool
+	}{
+		{"默认逐块输出", 0, false},
+		{"STREAM_COALESCE_MS 合并相邻增量", time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StreamCoalesce = tt.coalesce
+				c.InitialRoleChunk = false
+			})
+			chunks, _ := runStream(t, messageSource(deltas...), nil)
+			contentChunks := 0
+			for _, chunk := range chunks {
+				if text, _ := chunkContent(chunk); text != "" {
+					contentChunks++
+				}
+			}
+			if got := streamedContent(chunks); got != "abcdefgh" {
+				t.Errorf("content = %q, want %q", got, "abcdefgh")
+			}
+			if tt.wantFewer && contentChunks >= len(deltas) {
+				t.Errorf("输出 %d 个内容块, want 少于 %d", contentChunks, len(deltas))
+			}
+			if !tt.wantFewer && contentChunks != len(deltas) {
+				t.Errorf("输出 %d 个内容块, want %d", contentChunks, len(deltas))
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesSeparator(t *testing.T) {
+	messages := []ChatMessage{{Role: "user", Content: "a"}, {Role: "assistant", Content: "b"}}
+	tests := []struct {
+		name       string
+		terminator string
+		trim       bool
+		want       string
+	}{
+		{"默认去掉末尾分隔符", "\r\n", true, "user:a;\r\nassistant:b"},
+		{"关闭 TRIM_TRAILING_SEPARATOR", "\r\n", false, "user:a;\r\nassistant:b;\r\n"},
+		{"自定义 PROMPT_LINE_TERMINATOR", "\n", true, "user:a;\nassistant:b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PromptLineTerminator = tt.terminator
+				c.TrimTrailingSeparator = tt.trim
+			})
+			if got := prepareMessages(messages, "gpt-4o-mini"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesToolCalls(t *testing.T) {
+	var messages []ChatMessage
+	raw := `[
+		{"role":"user","content":"weather?"},
+		{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+		{"role":"user","content":"thanks"}
+	]`
+	if err := json.Unmarshal([]byte(raw), &messages); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		serialize bool
+		want      string
+	}{
+		{"默认忽略 tool_calls", false, "user:weather?;\r\nassistant:;\r\nuser:thanks"},
+		{"SERIALIZE_TOOL_CALLS 附加调用摘要", true, "user:weather?;\r\nassistant:[tool_call] get_weather({\"city\":\"Paris\"});\r\nuser:thanks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SerializeToolCalls = tt.serialize })
+			if got := prepareMessages(messages, "gpt-4o-mini"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitialRoleChunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{"默认首块即为携带 role 的内容", false},
+		{"INITIAL_ROLE_CHUNK 首块携带 role", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.InitialRoleChunk = tt.enabled })
+			chunks, _ := runStream(t, messageSource("hi"), nil)
+			if len(chunks) == 0 {
+				t.Fatal("没有收到数据块")
+			}
+			delta := chunks[0]["choices"].([]interface{})[0].(map[string]interface{})["delta"].(map[string]interface{})
+			want := map[string]interface{}{"role": "assistant", "content": "hi"}
+			if tt.enabled {
+				want = map[string]interface{}{"role": "assistant", "content": ""}
+			}
+			if !reflect.DeepEqual(delta, want) {
+				t.Errorf("首块 delta = %v, want %v", delta, want)
+			}
+		})
+	}
+}
+
+// junkVQDUpstream 第一次 status 请求返回格式异常的 token，之后返回正常 token
+type junkVQDUpstream struct {
+	scriptedUpstream
+	junk string
+}
+
+func (u *junkVQDUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/duckchat/v1/status" && u.statusCalls.Load() == 0 {
+		u.statusCalls.Add(1)
+		w.Header().Set("x-vqd-4", u.junk)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	u.scriptedUpstream.ServeHTTP(w, r)
+}
+
+func TestInvalidVQDRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		junk       string
+		wantStatus int32
+	}{
+		{"正常 token 直接使用", testVQD, 1},
+		{"模板占位符被丢弃后重新获取", "${vqd}", 2},
+		{"截断的 token 被丢弃后重新获取", "4-abc", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MaxRetryCount = 3
+				c.RetryDelay = 0
+				c.ResponseCacheTTL = 0
+			})
+			upstream := &junkVQDUpstream{junk: tt.junk}
+			withUpstream(t, upstream)
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if got := upstream.statusCalls.Load(); got != tt.wantStatus {
+				t.Errorf("token 请求 %d 次, want %d", got, tt.wantStatus)
+			}
+			if got := upstream.chatCalls.Load(); got != 1 {
+				t.Errorf("对话请求 %d 次, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int
+		want     int
+	}{
+		{"默认 64KB 允许较大的请求头", 64 << 10, http.StatusOK},
+		{"超过 MAX_HEADER_BYTES 返回 431", 1 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.MaxHeaderBytes = tt.maxBytes })
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+			server := httptest.NewUnstartedServer(handler)
+			server.Config = newServer("", handler)
+			server.Start()
+			t.Cleanup(server.Close)
+
+			// net/http 在 MaxHeaderBytes 之外还有 4KB 余量
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req.Header.Set("Cookie", strings.Repeat("a", 16<<10))
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"字符串", `"hi"`, "hi"},
+		{"内容数组", `[{"type":"text","text":"a"},{"type":"image_url","image_url":{"url":"x"}},{"type":"text","text":"b"}]`, "ab"},
+		{"单个内容对象", `{"type":"text","text":"single"}`, "single"},
+		{"整数", `123`, "123"},
+		{"大整数不使用科学计数法", `12345678901`, "12345678901"},
+		{"小数", `1.5`, "1.5"},
+		{"布尔值", `true`, "true"},
+		{"null", `null`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg ChatMessage
+			if err := json.Unmarshal([]byte(`{"role":"user","content":`+tt.content+`}`), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if got := messageText(msg); got != tt.want {
+				t.Errorf("messageText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamMaxBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxBuffer int
+		wantMin   int
+		wantMax   int
+	}{
+		{"默认缓冲足够合并全部内容", 65536, 1, 1},
+		{"超过 STREAM_MAX_BUFFER 时立即输出", 4, 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StreamCoalesce = time.Minute
+				c.StreamMaxBuffer = tt.maxBuffer
+				c.InitialRoleChunk = false
+			})
+			chunks, _ := runStream(t, messageSource("aa", "bb", "cc", "dd"), nil)
+			contentChunks := 0
+			for _, chunk := range chunks {
+				if text, _ := chunkContent(chunk); text != "" {
+					contentChunks++
+				}
+			}
+			if got := streamedContent(chunks); got != "aabbccdd" {
+				t.Errorf("content = %q, want %q", got, "aabbccdd")
+			}
+			if contentChunks < tt.wantMin || contentChunks > tt.wantMax {
+				t.Errorf("输出 %d 个内容块, want %d 到 %d 个", contentChunks, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestStreamSlowClient(t *testing.T) {
+	// 约 16MB 的输出，远超本机 socket 缓冲区
+	payload := strings.Repeat("x", 32<<10)
+	source := func(emit func(chunk map[string]interface{}) error) error {
+		for i := 0; i < 512; i++ {
+			if err := emit(map[string]interface{}{"message": payload}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tests := []struct {
+		name    string
+		read    bool
+		wantErr error
+	}{
+		{"正常读取的客户端", true, nil},
+		{"不读取的客户端在写入超时后被中止", false, errSlowClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StreamWriteTimeout = 200 * time.Millisecond
+				c.StreamCoalesce = 0
+			})
+			result := make(chan error, 1)
+			r := gin.New()
+			r.GET("/stream", func(c *gin.Context) {
+				result <- handleStreamResponse(c, source, "gpt-4o-mini", &ChatRequest{Model: "gpt-4o-mini", Stream: true}, &requestTiming{start: time.Now()}, nil)
+			})
+			server := httptest.NewServer(r)
+			t.Cleanup(server.Close)
+
+			resp, err := http.Get(server.URL + "/stream")
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			defer resp.Body.Close()
+			if tt.read {
+				io.Copy(io.Discard, resp.Body)
+			}
+
+			select {
+			case err := <-result:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("handleStreamResponse() = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("流式响应未结束")
+			}
+		})
+	}
+}
+
+func TestReportRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		report bool
+		chat   []int
+		want   interface{}
+	}{
+		{"默认不返回", false, []int{http.StatusBadGateway, http.StatusBadGateway}, nil},
+		{"REPORT_RETRIES 返回重试次数", true, []int{http.StatusBadGateway, http.StatusBadGateway}, float64(2)},
+		{"未重试时为 0", true, nil, float64(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ReportRetries = tt.report
+				c.MaxRetryCount = 3
+				c.RetryDelay = 0
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+				c.AdaptiveBlocking = false
+			})
+			withUpstream(t, &scriptedUpstream{chat: tt.chat})
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Usage map[string]interface{} `json:"usage"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的响应: %v", err)
+			}
+			if got := resp.Usage["retries"]; got != tt.want {
+				t.Errorf("usage.retries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// brokenStreamUpstream 第一次对话请求输出部分内容后断开连接，之后正常返回完整内容
+type brokenStreamUpstream struct {
+	scriptedUpstream
+	broken atomic.Bool
+}
+
+func (u *brokenStreamUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/duckchat/v1/chat" {
+		u.scriptedUpstream.ServeHTTP(w, r)
+		return
+	}
+	u.chatCalls.Add(1)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Write([]byte("data: {\"message\":\"hel\"}\n\n"))
+	w.(http.Flusher).Flush()
+	if u.broken.CompareAndSwap(false, true) {
+		panic(http.ErrAbortHandler)
+	}
+	w.Write([]byte("data: {\"message\":\"lo\"}\n\ndata: [DONE]\n\n"))
+}
+
+func TestReliableStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		reliable    bool
+		wantContent string
+		wantChat    int32
+	}{
+		{"默认直接转发, 中途断开无法重试", false, "hel", 1},
+		{"RELIABLE_STREAM 重试后完整重放", true, "hello", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ReliableStream = tt.reliable
+				c.MaxRetryCount = 3
+				c.RetryDelay = 0
+				c.FallbackModels = nil
+				c.AdaptiveBlocking = false
+				c.StreamErrorAsChunk = false
+			})
+			upstream := &brokenStreamUpstream{}
+			withUpstream(t, upstream)
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+
+			var content strings.Builder
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				data, ok := strings.CutPrefix(line, "data: ")
+				if !ok || data == "[DONE]" {
+					continue
+				}
+				var chunk map[string]interface{}
+				if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+					t.Fatalf("无效的数据块 %q: %v", data, err)
+				}
+				text, _ := chunkContent(chunk)
+				content.WriteString(text)
+			}
+			if got := content.String(); got != tt.wantContent {
+				t.Errorf("content = %q, want %q", got, tt.wantContent)
+			}
+			if got := upstream.chatCalls.Load(); got != tt.wantChat {
+				t.Errorf("对话请求 %d 次, want %d", got, tt.wantChat)
+			}
+		})
+	}
+}
+
+func TestPrepareMessagesCompactWhitespace(t *testing.T) {
+	messy := "first line   \n\n\n\nsecond\t\n```\ncode  \n\n\n  indented\n```\n\n\nend\n\n"
+	tests := []struct {
+		name    string
+		compact bool
+		want    string
+	}{
+		{"默认保持原样", false, "user:" + messy},
+		{"COMPACT_WHITESPACE 合并空行并去掉行尾空白, 代码块不变", true, "user:first line\n\nsecond\n```\ncode  \n\n\n  indented\n```\n\nend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.CompactWhitespace = tt.compact })
+			if got := prepareMessages([]ChatMessage{{Role: "user", Content: messy}}, "gpt-4o-mini"); got != tt.want {
+				t.Errorf("prepareMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstDeltaRole(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		wantRoles []bool
+	}{
+		{"默认只有第一个数据块携带 role", true, []bool{true, false, false, false}},
+		{"FIRST_DELTA_ROLE=false 时不携带 role", false, []bool{false, false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.FirstDeltaRole = tt.enabled
+				c.InitialRoleChunk = false
+				c.StreamCoalesce = 0
+			})
+			chunks, _ := runStream(t, messageSource("a", "b", "c"), nil)
+			var roles []bool
+			for _, chunk := range chunks {
+				choices, _ := chunk["choices"].([]interface{})
+				if len(choices) == 0 {
+					continue
+				}
+				delta, _ := choices[0].(map[string]interface{})["delta"].(map[string]interface{})
+				_, hasRole := delta["role"]
+				roles = append(roles, hasRole)
+			}
+			if !reflect.DeepEqual(roles, tt.wantRoles) {
+				t.Errorf("各数据块携带 role = %v, want %v", roles, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestRequireModel(t *testing.T) {
+	tests := []struct {
+		name       string
+		require    bool
+		body       string
+		headers    map[string]string
+		want       int
+		wantHeader string
+	}{
+		{"默认使用默认模型", false, `{"messages":[{"role":"user","content":"hi"}]}`, nil, http.StatusOK, "gpt-4o-mini"},
+		{"REQUIRE_MODEL 缺少 model 返回 400", true, `{"messages":[{"role":"user","content":"hi"}]}`, nil, http.StatusBadRequest, ""},
+		{"REQUIRE_MODEL 空白 model 返回 400", true, `{"model":"  ","messages":[{"role":"user","content":"hi"}]}`, nil, http.StatusBadRequest, ""},
+		{"REQUIRE_MODEL 指定了 model", true, `{"model":"claude-3-haiku","messages":[{"role":"user","content":"hi"}]}`, nil, http.StatusOK, "claude-3-haiku-20240307"},
+		{"允许的 X-DDG-Model 视为指定了模型", true, `{"messages":[{"role":"user","content":"hi"}]}`, map[string]string{"X-DDG-Model": "claude-3-haiku"}, http.StatusOK, "claude-3-haiku-20240307"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.RequireModel = tt.require
+				c.AllowModelOverride = true
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &scriptedUpstream{})
+			w := postCompletionWithHeaders(t, handleCompletion, tt.body, tt.headers)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				var resp struct {
+					Error struct {
+						Param string `json:"param"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Param != "model" {
+					t.Errorf("错误响应 = %s, want param model", w.Body.String())
+				}
+				return
+			}
+			if got := w.Header().Get("X-Upstream-Model"); got != tt.wantHeader {
+				t.Errorf("X-Upstream-Model = %q, want %q", got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestTruncationNotice(t *testing.T) {
+	tests := []struct {
+		name   string
+		notice string
+		finish string
+		want   string
+	}{
+		{"默认不附加", "", "length", "partial"},
+		{"max_tokens 截断时附加提示", "[truncated]", "length", "partial\n[truncated]"},
+		{"正常结束时不附加", "[truncated]", "stop", "partial"},
+	}
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/stream=%v", tt.name, stream), func(t *testing.T) {
+				withConfig(t, func(c *Config) {
+					c.TruncationNotice = tt.notice
+					c.ResponseCacheTTL = 0
+				})
+				withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/duckchat/v1/status" {
+						w.Header().Set("x-vqd-4", testVQD)
+						return
+					}
+					w.Header().Set("Content-Type", "text/event-stream")
+					fmt.Fprintf(w, "data: {\"message\":\"partial\"}\n\ndata: {\"finish_reason\":%q}\n\ndata: [DONE]\n\n", tt.finish)
+				}))
+				w := postCompletion(t, handleCompletion, fmt.Sprintf(`{"model":"gpt-4o-mini","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+				}
+
+				var content string
+				if stream {
+					var chunks []map[string]interface{}
+					for _, line := range strings.Split(w.Body.String(), "\n") {
+						if data, ok := strings.CutPrefix(line, "data: "); ok && data != "[DONE]" {
+							var chunk map[string]interface{}
+							json.Unmarshal([]byte(data), &chunk)
+							chunks = append(chunks, chunk)
+						}
+					}
+					content = streamedContent(chunks)
+				} else {
+					var resp struct {
+						Choices []struct {
+							Message struct {
+								Content string `json:"content"`
+							} `json:"message"`
+						} `json:"choices"`
+					}
+					if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 {
+						t.Fatalf("无效的响应: %s", w.Body.String())
+					}
+					content = resp.Choices[0].Message.Content
+				}
+				if content != tt.want {
+					t.Errorf("content = %q, want %q", content, tt.want)
+				}
+			})
+		}
+	}
+}
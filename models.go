@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ModelInfo 描述一个对外提供的模型及其对应的 DuckDuckGo 上游模型
+type ModelInfo struct {
+	ID       string `json:"id"`
+	Upstream string `json:"upstream"`
+	// DropParams 列出上游模型不接受、转发前需要移除的采样参数
+	DropParams []string `json:"drop_params,omitempty"`
+	// RenameParams 将采样参数改名后再转发，如 max_tokens -> max_completion_tokens
+	RenameParams map[string]string `json:"rename_params,omitempty"`
+	// Reasoning 标记会输出推理内容的模型，usage 中会返回估算的 reasoning_tokens
+	Reasoning bool `json:"reasoning,omitempty"`
+	// SystemRole 决定 system 消息的处理方式: user（默认，转为 user）、keep（保留）、merge（并入第一条 user 消息）
+	SystemRole string `json:"system_role,omitempty"`
+	// Pricing 为仅供展示的价格信息，供成本统计工具读取；DuckDuckGo 本身免费
+	Pricing *ModelPricing `json:"pricing,omitempty"`
+	// TimeoutMs 覆盖该模型对话请求的超时（毫秒），0 表示使用 UPSTREAM_TIMEOUT
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+}
+
+// ModelPricing 按 OpenRouter 的约定以每 token 的美元价格描述模型定价
+type ModelPricing struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+const (
+	systemRoleUser  = "user"
+	systemRoleKeep  = "keep"
+	systemRoleMerge = "merge"
+)
+
+var modelCatalog = []ModelInfo{
+	{ID: "gpt-4o-mini", Upstream: "gpt-4o-mini"},
+	{ID: "claude-3-haiku", Upstream: "claude-3-haiku-20240307"},
+	{ID: "llama-3.1-70b", Upstream: "meta-llama/Meta-Llama-3.1-70B-Instruct-Turbo"},
+	{ID: "mixtral-8x7b", Upstream: "mistralai/Mixtral-8x7B-Instruct-v0.1"},
+	{
+		ID:           "o3-mini",
+		Upstream:     "o3-mini",
+		DropParams:   []string{"temperature", "top_p", "presence_penalty", "frequency_penalty"},
+		RenameParams: map[string]string{"max_tokens": "max_completion_tokens"},
+		Reasoning:    true,
+		TimeoutMs:    120000,
+	},
+}
+
+// loadModelCatalog 从 JSON 文件加载模型目录，替换内置目录
+func loadModelCatalog(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var catalog []ModelInfo
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return fmt.Errorf("解析模型目录失败: %v", err)
+	}
+	for _, info := range catalog {
+		if info.ID == "" || info.Upstream == "" {
+			return fmt.Errorf("模型目录中存在缺少 id 或 upstream 的条目")
+		}
+		switch info.SystemRole {
+		case "", systemRoleUser, systemRoleKeep, systemRoleMerge:
+		default:
+			return fmt.Errorf("模型 %s 的 system_role 无效: %s", info.ID, info.SystemRole)
+		}
+		if info.Pricing != nil && (info.Pricing.Prompt < 0 || info.Pricing.Completion < 0) {
+			return fmt.Errorf("模型 %s 的 pricing 不能为负数", info.ID)
+		}
+		if info.TimeoutMs < 0 {
+			return fmt.Errorf("模型 %s 的 timeout_ms 不能为负数", info.ID)
+		}
+	}
+	if len(catalog) == 0 {
+		return fmt.Errorf("模型目录为空")
+	}
+
+	modelCatalog = catalog
+	return nil
+}
+
+// normalizeModelID 统一模型 id 的比较方式，列表、查询、校验与转换都基于它做不区分大小写的匹配
+func normalizeModelID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// toOpenAI 返回 /v1/models 中的模型对象，id 统一为规范化形式，配置了价格时附带 pricing
+func (info ModelInfo) toOpenAI() map[string]interface{} {
+	model := map[string]interface{}{"id": normalizeModelID(info.ID), "object": "model", "owned_by": "ddg"}
+	if info.Pricing != nil {
+		model["pricing"] = info.Pricing
+	}
+	return model
+}
+
+func findModel(id string) (ModelInfo, bool) {
+	id = normalizeModelID(id)
+	for _, info := range modelCatalog {
+		if normalizeModelID(info.ID) == id {
+			return info, true
+		}
+	}
+	return ModelInfo{}, false
+}
+
+// defaultModelAliases 将常见的 OpenAI 官方模型名映射到目录中的模型
+var defaultModelAliases = map[string]string{
+	"gpt-3.5-turbo": "gpt-4o-mini",
+	"gpt-4":         "gpt-4o-mini",
+	"gpt-4-turbo":   "gpt-4o-mini",
+	"gpt-4o":        "gpt-4o-mini",
+	"o1-mini":       "o3-mini",
+	"o1":            "o3-mini",
+}
+
+// parseModelAliases 解析 MODEL_ALIASES 并与内置别名合并，键统一规范化
+func parseModelAliases(raw string) map[string]string {
+	aliases := make(map[string]string, len(defaultModelAliases))
+	for alias, target := range defaultModelAliases {
+		aliases[alias] = target
+	}
+	if raw == "" {
+		return aliases
+	}
+	var custom map[string]string
+	if err := json.Unmarshal([]byte(raw), &custom); err != nil {
+		log.Printf("MODEL_ALIASES 解析失败, 仅使用内置别名: %v", err)
+		return aliases
+	}
+	for alias, target := range custom {
+		aliases[normalizeModelID(alias)] = target
+	}
+	return aliases
+}
+
+// stripModelAffixes 去掉网关附加的前后缀：在 MODEL_SUFFIX_SEPARATORS 中任一字符首次出现处截断，
+// 并取 MODEL_PREFIX_SEPARATORS 中任一字符最后一次出现之后的部分，
+// 如 gpt-4o-mini@latest、gpt-4o-mini:free、openai/gpt-4o-mini 都得到 gpt-4o-mini
+func stripModelAffixes(id string) string {
+	if i := strings.IndexAny(id, config.ModelSuffixSeparators); i > 0 {
+		id = id[:i]
+	}
+	if i := strings.LastIndexAny(id, config.ModelPrefixSeparators); i >= 0 && i < len(id)-1 {
+		id = id[i+1:]
+	}
+	return id
+}
+
+// resolveModel 依次按目录 id、上游模型名、别名查找模型；未命中时去掉前后缀重新查找，
+// 最后按前缀匹配，如 gpt-4o-mini-2024-07-18 匹配 gpt-4o-mini，取最长的前缀
+func resolveModel(id string) (ModelInfo, bool) {
+	if info, ok := findModel(id); ok {
+		return info, true
+	}
+	if info, ok := findUpstreamModel(id); ok {
+		return info, true
+	}
+	id = normalizeModelID(id)
+	if target, ok := config.ModelAliases[id]; ok {
+		return findModel(target)
+	}
+	if stripped := stripModelAffixes(id); stripped != id {
+		return resolveModel(stripped)
+	}
+
+	var best string
+	var bestInfo ModelInfo
+	consider := func(prefix string, info ModelInfo) {
+		if len(prefix) > len(best) && strings.HasPrefix(id, prefix+"-") {
+			best, bestInfo = prefix, info
+		}
+	}
+	for _, info := range modelCatalog {
+		consider(normalizeModelID(info.ID), info)
+	}
+	for alias, target := range config.ModelAliases {
+		if info, ok := findModel(target); ok {
+			consider(alias, info)
+		}
+	}
+	return bestInfo, best != ""
+}
+
+// findUpstreamModel 根据上游模型 id 查找目录条目，与 findModel 一样不区分大小写
+func findUpstreamModel(upstream string) (ModelInfo, bool) {
+	upstream = normalizeModelID(upstream)
+	for _, info := range modelCatalog {
+		if normalizeModelID(info.Upstream) == upstream {
+			return info, true
+		}
+	}
+	return ModelInfo{}, false
+}
+
+// upstreamTimeout 返回上游模型对话请求的超时，目录中未单独配置时使用 UPSTREAM_TIMEOUT
+func upstreamTimeout(upstream string) time.Duration {
+	if info, ok := findUpstreamModel(upstream); ok && info.TimeoutMs > 0 {
+		return time.Duration(info.TimeoutMs) * time.Millisecond
+	}
+	return config.UpstreamTimeout
+}
+
+// samplingParams 收集客户端显式设置的采样参数
+func samplingParams(req *ChatRequest) map[string]interface{} {
+	params := make(map[string]interface{})
+	if req.Temperature != nil {
+		params["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		params["top_p"] = *req.TopP
+	}
+	if req.MaxTokens != nil {
+		params["max_tokens"] = *req.MaxTokens
+	}
+	if req.PresencePenalty != nil {
+		params["presence_penalty"] = *req.PresencePenalty
+	}
+	if req.FrequencyPenalty != nil {
+		params["frequency_penalty"] = *req.FrequencyPenalty
+	}
+	if req.Stop != nil {
+		params["stop"] = req.Stop
+	}
+	return params
+}
+
+// translateParams 按模型配置移除或改名上游不接受的参数，避免上游返回 400
+func (info ModelInfo) translateParams(params map[string]interface{}) map[string]interface{} {
+	for _, name := range info.DropParams {
+		delete(params, name)
+	}
+	for from, to := range info.RenameParams {
+		if value, ok := params[from]; ok {
+			delete(params, from)
+			params[to] = value
+		}
+	}
+	return params
+}
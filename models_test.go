@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertModel(t *testing.T) {
+	tests := []struct {
+		input   string
+		aliases string
+		// suffix、prefix 非空时覆盖 MODEL_SUFFIX_SEPARATORS 与 MODEL_PREFIX_SEPARATORS
+		suffix string
+		prefix string
+		want   string
+	}{
+		{"gpt-4o-mini", "", "", "", "gpt-4o-mini"},
+		{"GPT-4o-Mini ", "", "", "", "gpt-4o-mini"},
+		{"claude-3-haiku", "", "", "", "claude-3-haiku-20240307"},
+		{"claude-3-haiku-20240307", "", "", "", "claude-3-haiku-20240307"},
+		{"gpt-4", "", "", "", "gpt-4o-mini"},
+		{"gpt-3.5-turbo", "", "", "", "gpt-4o-mini"},
+		{"o1-mini", "", "", "", "o3-mini"},
+		{"gpt-4o-mini-2024-07-18", "", "", "", "gpt-4o-mini"},
+		{"gpt-4-turbo-2024-04-09", "", "", "", "gpt-4o-mini"},
+		{"my-model", `{"My-Model":"claude-3-haiku"}`, "", "", "claude-3-haiku-20240307"},
+		{"openai/o3-mini", "", "", "", "o3-mini"},
+		{"gpt-4o-mini@latest", "", "", "", "gpt-4o-mini"},
+		{"llama-3.1-70b:free", "", "", "", "meta-llama/Meta-Llama-3.1-70B-Instruct-Turbo"},
+		{"openrouter/claude-3-haiku:beta", "", "", "", "claude-3-haiku-20240307"},
+		{"claude-3-haiku#v2", "", "#", "", "claude-3-haiku-20240307"},
+		{"vendor|claude-3-haiku", "", "", "|", "claude-3-haiku-20240307"},
+		{"unknown-model", "", "", "", "gpt-4o-mini"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ModelAliases = parseModelAliases(tt.aliases)
+				if tt.suffix != "" {
+					c.ModelSuffixSeparators = tt.suffix
+				}
+				if tt.prefix != "" {
+					c.ModelPrefixSeparators = tt.prefix
+				}
+			})
+			if got := convertModel(tt.input); got != tt.want {
+				t.Errorf("convertModel(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindUpstreamModel(t *testing.T) {
+	tests := []struct {
+		upstream string
+		wantID   string
+		ok       bool
+	}{
+		{"gpt-4o-mini", "gpt-4o-mini", true},
+		{"GPT-4o-Mini", "gpt-4o-mini", true},
+		{" claude-3-haiku-20240307 ", "claude-3-haiku", true},
+		{"meta-llama/meta-llama-3.1-70b-instruct-turbo", "llama-3.1-70b", true},
+		{"gpt-5", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			info, ok := findUpstreamModel(tt.upstream)
+			if ok != tt.ok || info.ID != tt.wantID {
+				t.Errorf("findUpstreamModel(%q) = %q, %v; want %q, %v", tt.upstream, info.ID, ok, tt.wantID, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTranslateParams(t *testing.T) {
+	temperature, topP := 0.2, 0.9
+	maxTokens := 100
+	req := &ChatRequest{Temperature: &temperature, TopP: &topP, MaxTokens: &maxTokens}
+	tests := []struct {
+		name string
+		info ModelInfo
+		want map[string]interface{}
+	}{
+		{
+			name: "默认原样转发",
+			want: map[string]interface{}{"temperature": 0.2, "top_p": 0.9, "max_tokens": 100},
+		},
+		{
+			name: "丢弃与重命名",
+			info: ModelInfo{DropParams: []string{"top_p"}, RenameParams: map[string]string{"max_tokens": "max_completion_tokens"}},
+			want: map[string]interface{}{"temperature": 0.2, "max_completion_tokens": 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.translateParams(samplingParams(req)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("translateParams = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelsPricing(t *testing.T) {
+	saved := modelCatalog
+	t.Cleanup(func() { modelCatalog = saved })
+	path := filepath.Join(t.TempDir(), "models.json")
+	catalog := `[
+		{"id": "gpt-4o-mini", "upstream": "gpt-4o-mini", "pricing": {"prompt": 0.00000015, "completion": 0.0000006}},
+		{"id": "claude-3-haiku", "upstream": "claude-3-haiku-20240307"}
+	]`
+	if err := os.WriteFile(path, []byte(catalog), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadModelCatalog(path); err != nil {
+		t.Fatalf("loadModelCatalog: %v", err)
+	}
+
+	withConfig(t, func(c *Config) { c.APIPrefix = "/" })
+	r, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	var resp struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("无效的响应: %v", err)
+	}
+
+	tests := []struct {
+		id   string
+		want interface{}
+	}{
+		{"gpt-4o-mini", map[string]interface{}{"prompt": 0.00000015, "completion": 0.0000006}},
+		{"claude-3-haiku", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			for _, model := range resp.Data {
+				if model["id"] == tt.id {
+					if got := model["pricing"]; !reflect.DeepEqual(got, tt.want) {
+						t.Errorf("pricing = %v, want %v", got, tt.want)
+					}
+					return
+				}
+			}
+			t.Errorf("/v1/models 中没有 %s", tt.id)
+		})
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	saved := modelCatalog
+	t.Cleanup(func() { modelCatalog = saved })
+	modelCatalog = []ModelInfo{
+		{ID: "gpt-4o-mini", Upstream: "gpt-4o-mini"},
+		{ID: "o3-mini", Upstream: "o3-mini", TimeoutMs: 2000},
+	}
+	// 对话请求在 300ms 后才返回
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/duckchat/v1/chat" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		(&scriptedUpstream{}).ServeHTTP(w, r)
+	})
+
+	tests := []struct {
+		model       string
+		wantTimeout time.Duration
+		wantStatus  int
+	}{
+		{"gpt-4o-mini", 100 * time.Millisecond, http.StatusBadGateway},
+		{"o3-mini", 2 * time.Second, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.UpstreamTimeout = 100 * time.Millisecond
+				c.MaxRetryCount = 1
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+			})
+			if got := upstreamTimeout(tt.model); got != tt.wantTimeout {
+				t.Errorf("upstreamTimeout(%q) = %v, want %v", tt.model, got, tt.wantTimeout)
+			}
+			withUpstream(t, slow)
+			w := postCompletion(t, handleCompletion, `{"model":"`+tt.model+`","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
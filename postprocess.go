@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// postprocessText 将完整的回复文本通过 stdin 交给 POSTPROCESS_CMD 处理，使用其 stdout 作为结果；
+// 命令超时、退出码非 0 时记录日志并返回原文
+func postprocessText(text string) string {
+	if config.PostprocessCmd == "" {
+		return text
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.PostprocessTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", config.PostprocessCmd)
+	cmd.Stdin = strings.NewReader(text)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("后处理命令执行失败, 使用原始回复: %v %s", err, strings.TrimSpace(stderr.String()))
+		return text
+	}
+	return stdout.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPostprocessText(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		timeout time.Duration
+		want    string
+	}{
+		{"默认不处理", "", time.Second, "hello"},
+		{"使用命令输出", "tr a-z A-Z", time.Second, "HELLO"},
+		{"命令失败时返回原文", "exit 1", time.Second, "hello"},
+		{"命令超时时返回原文", "exec sleep 5", 100 * time.Millisecond, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.PostprocessCmd = tt.cmd
+				c.PostprocessTimeout = tt.timeout
+			})
+			if got := postprocessText("hello"); got != tt.want {
+				t.Errorf("postprocessText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamPostprocess(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.PostprocessCmd = "tr a-z A-Z"
+		c.PostprocessTimeout = time.Second
+	})
+	chunks, _ := runStream(t, messageSource("hel", "lo"), nil)
+	if got := streamedContent(chunks); got != "HELLO" {
+		t.Errorf("content = %q, want %q", got, "HELLO")
+	}
+}
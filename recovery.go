@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// panicTotal 统计处理函数中发生的 panic 次数，通过 /livez 返回
+var panicTotal atomic.Uint64
+
+// recoveryMiddleware 替代 gin 默认的 Recovery：记录带 request_id 的 panic 日志，
+// 响应头未写出时返回 500 JSON，流式响应已开始时补发错误数据块与 [DONE] 后再结束连接
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// 与 net/http 约定一致，ErrAbortHandler 用于主动中断连接，不视为异常
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+
+			panicTotal.Add(1)
+			logger := &attemptLogger{RequestID: c.GetString(requestIDContextKey)}
+			if config.PanicStackTrace {
+				logger.Printf("处理 %s %s 时发生 panic: %v\n%s", c.Request.Method, c.Request.URL.Path, recovered, debug.Stack())
+			} else {
+				logger.Printf("处理 %s %s 时发生 panic: %v", c.Request.Method, c.Request.URL.Path, recovered)
+			}
+
+			err := fmt.Errorf("服务内部错误: %v", recovered)
+			switch {
+			case !c.Writer.Written():
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "type": "internal_error"})
+			case strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream"):
+				data, _ := json.Marshal(gin.H{"error": gin.H{"message": err.Error(), "type": "internal_error"}})
+				fmt.Fprintf(c.Writer, "data: %s\n\ndata: [DONE]\n\n", data)
+				c.Writer.Flush()
+				c.Abort()
+			default:
+				c.Abort()
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		stackTrace bool
+		wantStatus int
+		wantBody   []string
+		wantStack  bool
+	}{
+		{"响应前 panic 返回 500 JSON", func(c *gin.Context) { panic("boom") }, true, http.StatusInternalServerError,
+			[]string{`"type":"internal_error"`, "服务内部错误: boom"}, true},
+		{"流式响应中 panic 补发错误块与 [DONE]", func(c *gin.Context) {
+			c.Header("Content-Type", "text/event-stream")
+			c.Writer.WriteString("data: {}\n\n")
+			panic("boom")
+		}, false, http.StatusOK, []string{`data: {"error":{"message":"服务内部错误: boom","type":"internal_error"}}`, "data: [DONE]"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.PanicStackTrace = tt.stackTrace })
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+			before := panicTotal.Load()
+
+			r := gin.New()
+			r.Use(requestIDMiddleware(), recoveryMiddleware())
+			r.GET("/panic", tt.handler)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+			req.Header.Set("X-Request-ID", "req-panic")
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("响应 %q 缺少 %q", w.Body.String(), want)
+				}
+			}
+			logged := buf.String()
+			if !strings.Contains(logged, "[request_id=req-panic] 处理 GET /panic 时发生 panic: boom") {
+				t.Errorf("日志缺少带 request_id 的 panic 记录: %s", logged)
+			}
+			if got := strings.Contains(logged, "goroutine "); got != tt.wantStack {
+				t.Errorf("日志包含调用栈 = %v, want %v", got, tt.wantStack)
+			}
+			if got := panicTotal.Load() - before; got != 1 {
+				t.Errorf("panic 计数增加 %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultRefusalPattern 匹配常见的中英文拒答开头
+const defaultRefusalPattern = `(?i)^(I'm sorry|I am sorry|I apologize|I can't (help|assist)|I cannot (help|assist)|抱歉|对不起|很抱歉)`
+
+var refusalRe *regexp.Regexp
+
+func compileRefusalPattern(pattern string) error {
+	if pattern == "" {
+		pattern = defaultRefusalPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	refusalRe = re
+	return nil
+}
+
+// isRefusal 判断完整响应是否为上游的拒答
+func isRefusal(content string) bool {
+	if refusalRe == nil {
+		return false
+	}
+	return refusalRe.MatchString(strings.TrimSpace(content))
+}
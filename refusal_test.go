@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestIsRefusal(t *testing.T) {
+	saved := refusalRe
+	t.Cleanup(func() { refusalRe = saved })
+	if err := compileRefusalPattern(""); err != nil {
+		t.Fatalf("compileRefusalPattern: %v", err)
+	}
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"I'm sorry, but I can't help with that.", true},
+		{"  i cannot assist with this request", true},
+		{"抱歉，我无法回答这个问题。", true},
+		{"Sure! I'm sorry to hear that.", false},
+		{"好的，下面是答案", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			if got := isRefusal(tt.content); got != tt.want {
+				t.Errorf("isRefusal(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefusalResponse(t *testing.T) {
+	saved := refusalRe
+	t.Cleanup(func() { refusalRe = saved })
+	if err := compileRefusalPattern(""); err != nil {
+		t.Fatalf("compileRefusalPattern: %v", err)
+	}
+	tests := []struct {
+		name       string
+		detect     bool
+		asError    bool
+		want       int
+		wantFinish string
+	}{
+		{"默认不识别", false, false, http.StatusOK, "stop"},
+		{"DETECT_REFUSALS 标记 content_filter", true, false, http.StatusOK, "content_filter"},
+		{"REFUSAL_AS_ERROR 返回错误", true, true, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.DetectRefusals = tt.detect
+				c.RefusalAsError = tt.asError
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/duckchat/v1/status" {
+					w.Header().Set("x-vqd-4", testVQD)
+					return
+				}
+				w.Write([]byte("data: {\"message\":\"I'm sorry, I can't help with that.\"}\n\ndata: [DONE]\n\n"))
+			}))
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.wantFinish == "" {
+				return
+			}
+			var resp struct {
+				Choices []struct {
+					FinishReason string `json:"finish_reason"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) != 1 {
+				t.Fatalf("无效的响应: %v, body = %s", err, w.Body.String())
+			}
+			if resp.Choices[0].FinishReason != tt.wantFinish {
+				t.Errorf("finish_reason = %q, want %q", resp.Choices[0].FinishReason, tt.wantFinish)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDContextKey 保存当前请求的 id，供日志关联使用
+const requestIDContextKey = "requestID"
+
+// requestIDMiddleware 沿用客户端传入的 X-Request-ID，否则生成新的 id，并在响应头中返回（受 EXPOSE_DIAG_HEADERS 控制）
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		c.Set(requestIDContextKey, id)
+		setDiagHeader(c, "X-Request-ID", id)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// attemptLogger 为日志加上 request_id 与 attempt 字段，同一请求的多次上游尝试可以一起检索；
+// Attempt 为 0 表示与具体尝试无关的请求级日志，nil 时不带任何字段
+type attemptLogger struct {
+	RequestID string
+	Attempt   int
+}
+
+func (l *attemptLogger) Printf(format string, args ...interface{}) {
+	if l == nil {
+		log.Printf(format, args...)
+		return
+	}
+	prefix := fmt.Sprintf("[request_id=%s] ", l.RequestID)
+	if l.Attempt > 0 {
+		prefix = fmt.Sprintf("[request_id=%s attempt=%d] ", l.RequestID, l.Attempt)
+	}
+	log.Printf(prefix+format, args...)
+}
+
+type attemptLoggerKey struct{}
+
+func withAttemptLogger(ctx context.Context, logger *attemptLogger) context.Context {
+	return context.WithValue(ctx, attemptLoggerKey{}, logger)
+}
+
+// attemptLoggerFrom 取出上下文中的 attemptLogger，未设置时返回 nil
+func attemptLoggerFrom(ctx context.Context) *attemptLogger {
+	logger, _ := ctx.Value(attemptLoggerKey{}).(*attemptLogger)
+	return logger
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAttemptLogCorrelation(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxRetryCount = 3
+		c.RetryDelay = 0
+		c.ResponseCacheTTL = 0
+		c.FallbackModels = nil
+		c.AdaptiveBlocking = false
+	})
+	withUpstream(t, &scriptedUpstream{chat: []int{http.StatusBadGateway, http.StatusBadGateway}})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	r := gin.New()
+	r.Use(requestIDMiddleware())
+	r.POST("/v1/chat/completions", handleCompletion)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "req-123")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"[request_id=req-123 attempt=1] 发送 token 请求",
+		"[request_id=req-123 attempt=2] 发送 token 请求",
+		"[request_id=req-123 attempt=3] 发送 token 请求",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("日志缺少 %q:\n%s", want, out)
+		}
+	}
+	// 与尝试相关的日志都应带有同一 request_id
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.Contains(line, "attempt=") && !strings.Contains(line, "request_id=req-123 ") {
+			t.Errorf("日志行缺少关联字段: %s", line)
+		}
+	}
+}
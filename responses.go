@@ -0,0 +1,112 @@
+package main
+
+import "time"
+
+const completionID = "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK"
+
+// completionMeta 是同一次响应中所有 chunk 共享的字段
+type completionMeta struct {
+	ID      string
+	Model   string
+	Created int64
+	// 目前只支持单个 choice，索引固定为 0
+	ChoiceIndex int
+	Logprobs    bool
+	// Reasoning 为 true 时在 usage 中返回 completion_tokens_details.reasoning_tokens
+	Reasoning bool
+	// ConversationID 非空时在每个流式数据块中附带 conversation_id
+	ConversationID string
+}
+
+// completionResult 是非流式响应读取完成后的结果
+type completionResult struct {
+	Content      string
+	FinishReason string
+	// ReasoningTokens 为被 STRIP_THINK 移除的推理内容的估算 token 数
+	ReasoningTokens int
+	// Retries 为得到该结果前的重试次数
+	Retries int
+	// Truncated 表示内容因 STOP_REGEX 命中被截断
+	Truncated bool
+}
+
+// truncationNotice 在输出被截断（finish_reason 为 length 或 STOP_REGEX 命中）时返回换行加 TRUNCATION_NOTICE，
+// 正常结束或未配置时返回空字符串
+func truncationNotice(finishReason string, truncated bool) string {
+	if config.TruncationNotice == "" || (finishReason != "length" && !truncated) {
+		return ""
+	}
+	return "\n" + config.TruncationNotice
+}
+
+func newCompletionMeta(model string, req *ChatRequest) completionMeta {
+	info, _ := findUpstreamModel(model)
+	return completionMeta{
+		ID:        completionID,
+		Model:     model,
+		Created:   time.Now().Unix(),
+		Logprobs:  req.Logprobs,
+		Reasoning: info.Reasoning,
+	}
+}
+
+// buildChoice 构建单个 choice，field 为 message（非流式）或 delta（流式）；
+// 客户端请求 logprobs 时显式返回 null
+func buildChoice(index int, field string, value map[string]string, finishReason interface{}, logprobs bool) map[string]interface{} {
+	choice := map[string]interface{}{
+		"index":         index,
+		field:           value,
+		"finish_reason": finishReason,
+	}
+	if logprobs {
+		choice["logprobs"] = nil
+	}
+	return choice
+}
+
+// buildChunk 构建流式响应的 chat.completion.chunk，内容块与终止块共用
+func buildChunk(meta completionMeta, delta map[string]string, finishReason interface{}) map[string]interface{} {
+	chunk := map[string]interface{}{
+		"id":      meta.ID,
+		"object":  "chat.completion.chunk",
+		"created": meta.Created,
+		"model":   meta.Model,
+		"choices": []map[string]interface{}{
+			buildChoice(meta.ChoiceIndex, "delta", delta, finishReason, meta.Logprobs),
+		},
+	}
+	if meta.ConversationID != "" {
+		chunk["conversation_id"] = meta.ConversationID
+	}
+	return chunk
+}
+
+// buildFinalResponse 构建非流式的 chat.completion 响应
+func buildFinalResponse(meta completionMeta, result completionResult) map[string]interface{} {
+	usage := map[string]interface{}{
+		"prompt_tokens":     0,
+		"completion_tokens": 0,
+		"total_tokens":      0,
+	}
+	if meta.Reasoning {
+		usage["completion_tokens_details"] = map[string]int{"reasoning_tokens": result.ReasoningTokens}
+	}
+	// 非标准字段，严格校验 usage 的客户端可能拒绝，需通过 REPORT_RETRIES 开启
+	if config.ReportRetries {
+		usage["retries"] = result.Retries
+	}
+
+	return map[string]interface{}{
+		"id":      meta.ID,
+		"object":  "chat.completion",
+		"created": meta.Created,
+		"model":   meta.Model,
+		"usage":   usage,
+		"choices": []map[string]interface{}{
+			buildChoice(meta.ChoiceIndex, "message", map[string]string{
+				"role":    "assistant",
+				"content": result.Content,
+			}, result.FinishReason, meta.Logprobs),
+		},
+	}
+}
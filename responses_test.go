@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildChunk(t *testing.T) {
+	meta := completionMeta{ID: completionID, Model: "gpt-4o-mini", Created: 1700000000}
+	tests := []struct {
+		name         string
+		delta        map[string]string
+		finishReason interface{}
+	}{
+		{"内容块", map[string]string{"content": "hi"}, nil},
+		{"终止块", map[string]string{}, "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildChunk(meta, tt.delta, tt.finishReason)
+			want := map[string]interface{}{
+				"id":      completionID,
+				"object":  "chat.completion.chunk",
+				"created": int64(1700000000),
+				"model":   "gpt-4o-mini",
+				"choices": []map[string]interface{}{
+					{"index": 0, "delta": tt.delta, "finish_reason": tt.finishReason},
+				},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("buildChunk() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildFinalResponse(t *testing.T) {
+	meta := completionMeta{ID: completionID, Model: "gpt-4o-mini", Created: 1700000000}
+	got := buildFinalResponse(meta, completionResult{Content: "hi", FinishReason: "stop"})
+	want := map[string]interface{}{
+		"id":      completionID,
+		"object":  "chat.completion",
+		"created": int64(1700000000),
+		"model":   "gpt-4o-mini",
+		"usage": map[string]interface{}{
+			"prompt_tokens":     0,
+			"completion_tokens": 0,
+			"total_tokens":      0,
+		},
+		"choices": []map[string]interface{}{
+			{"index": 0, "message": map[string]string{"role": "assistant", "content": "hi"}, "finish_reason": "stop"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildFinalResponse() = %v, want %v", got, want)
+	}
+}
+
+func TestReasoningTokensUsage(t *testing.T) {
+	const reasoning = "先分析问题, then answer"
+	tests := []struct {
+		name       string
+		model      string
+		stripThink bool
+		wantTokens interface{}
+	}{
+		{"普通模型不返回 reasoning_tokens", "gpt-4o-mini", true, nil},
+		{"推理模型返回估算值", "o3-mini", true, estimateTokens(reasoning)},
+		{"未启用 STRIP_THINK 时为 0", "o3-mini", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.StripThink = tt.stripThink
+				c.ThinkStart = "<think>"
+				c.ThinkEnd = "</think>"
+			})
+			result, err := handleNonStreamResponse(messageSource("<think>"+reasoning, "</think>hi"), nil)
+			if err != nil {
+				t.Fatalf("handleNonStreamResponse: %v", err)
+			}
+			resp := buildFinalResponse(newCompletionMeta(tt.model, &ChatRequest{Model: tt.model}), result)
+			usage := resp["usage"].(map[string]interface{})
+			details, ok := usage["completion_tokens_details"].(map[string]int)
+			if tt.wantTokens == nil {
+				if ok {
+					t.Errorf("completion_tokens_details = %v, want 不存在", details)
+				}
+				return
+			}
+			if !ok || details["reasoning_tokens"] != tt.wantTokens {
+				t.Errorf("completion_tokens_details = %v, want reasoning_tokens %v", usage["completion_tokens_details"], tt.wantTokens)
+			}
+		})
+	}
+}
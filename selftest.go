@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// selfTestCheck 是启动自检中的一项，err 非空表示检查失败
+type selfTestCheck struct {
+	name string
+	err  error
+}
+
+// runSelfTest 检查配置文件、代理、正则等配置是否有效，并实际请求一次上游 token，返回所有检查结果
+func runSelfTest() []selfTestCheck {
+	var checks []selfTestCheck
+	add := func(name string, err error) {
+		checks = append(checks, selfTestCheck{name: name, err: err})
+	}
+
+	if config.ProxyURL != "" {
+		_, err := url.Parse(config.ProxyURL)
+		add("PROXY_URL", err)
+	}
+	if config.ModelsFile != "" {
+		add("MODELS_FILE", loadModelCatalog(config.ModelsFile))
+	}
+	if config.APIKeysFile != "" {
+		add("APIKEYS_FILE", apiKeys.load(config.APIKeysFile))
+	}
+	if raw := getEnv("UPSTREAM_BODY_TEMPLATE", ""); raw != "" {
+		var template map[string]interface{}
+		add("UPSTREAM_BODY_TEMPLATE", json.Unmarshal([]byte(raw), &template))
+	}
+	if _, ok := tlsVersions[config.TLSMinVersion]; !ok {
+		add("UPSTREAM_TLS_MIN_VERSION", fmt.Errorf("不支持的版本: %s", config.TLSMinVersion))
+	}
+	if config.StopRegex != "" {
+		_, err := regexp.Compile(config.StopRegex)
+		add("STOP_REGEX", err)
+	}
+	if config.DetectRefusals && config.RefusalPattern != "" {
+		_, err := regexp.Compile(config.RefusalPattern)
+		add("REFUSAL_PATTERN", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	_, err := requestToken(ctx)
+	add("上游 token", err)
+
+	return checks
+}
+
+// reportSelfTest 输出自检报告，存在失败项时返回 false
+func reportSelfTest(checks []selfTestCheck) bool {
+	ok := true
+	for _, check := range checks {
+		if check.err != nil {
+			ok = false
+			log.Printf("[自检] %s: 失败: %v", check.name, check.err)
+		} else {
+			log.Printf("[自检] %s: 通过", check.name)
+		}
+	}
+	return ok
+}
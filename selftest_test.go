@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	failing := make([]int, 10)
+	for i := range failing {
+		failing[i] = http.StatusForbidden
+	}
+	tests := []struct {
+		name       string
+		configure  func(*Config)
+		upstream   *scriptedUpstream
+		wantFailed []string
+		wantOK     bool
+	}{
+		{"默认配置通过", func(*Config) {}, &scriptedUpstream{}, nil, true},
+		{"配置错误与上游不可用均被报告", func(c *Config) {
+			c.ModelsFile = filepath.Join(t.TempDir(), "missing.json")
+			c.StopRegex = "("
+			c.TLSMinVersion = "1.9"
+		}, &scriptedUpstream{status: failing}, []string{"MODELS_FILE", "UPSTREAM_TLS_MIN_VERSION", "STOP_REGEX", "上游 token"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.configure)
+			withUpstream(t, tt.upstream)
+			checks := runSelfTest()
+			var failed []string
+			for _, check := range checks {
+				if check.err != nil {
+					failed = append(failed, check.name)
+				}
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("失败项 = %q, want %q", failed, tt.wantFailed)
+			}
+			if got := reportSelfTest(checks); got != tt.wantOK {
+				t.Errorf("reportSelfTest() = %v, want %v", got, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+const (
+	splitModeSplit    = "split"
+	splitModeTruncate = "truncate"
+)
+
+// truncatedNotice 附加在被截断消息的末尾，提示模型内容不完整
+const truncatedNotice = "\n[内容过长, 已截断]"
+
+// splitLargeMessages 处理超过 MAX_MESSAGE_CHARS 个字符的单条消息：
+// split 模式拆成多条同角色的连续消息，truncate 模式只保留开头并附加截断提示
+func splitLargeMessages(messages []ChatMessage) []ChatMessage {
+	limit := config.MaxMessageChars
+	if limit <= 0 {
+		return messages
+	}
+
+	result := make([]ChatMessage, 0, len(messages))
+	for _, msg := range messages {
+		runes := []rune(messageText(msg))
+		if len(runes) <= limit {
+			result = append(result, msg)
+			continue
+		}
+
+		if config.SplitLargeMessages == splitModeTruncate {
+			msg.Content = string(runes[:limit]) + truncatedNotice
+			result = append(result, msg)
+			continue
+		}
+
+		parts := splitRunes(runes, limit)
+		for i, part := range parts {
+			piece := ChatMessage{Role: msg.Role, Name: msg.Name, Content: fmt.Sprintf("[%d/%d] %s", i+1, len(parts), part)}
+			// 工具调用只保留在最后一段，避免重复
+			if i == len(parts)-1 {
+				piece.ToolCalls = msg.ToolCalls
+			}
+			result = append(result, piece)
+		}
+	}
+	return result
+}
+
+// splitRunes 按最多 limit 个字符切分文本，切分点尽量落在后半段的最后一个换行处
+func splitRunes(runes []rune, limit int) []string {
+	var parts []string
+	for len(runes) > limit {
+		cut := limit
+		for i := limit - 1; i >= limit/2; i-- {
+			if runes[i] == '\n' {
+				cut = i + 1
+				break
+			}
+		}
+		parts = append(parts, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	if len(runes) > 0 {
+		parts = append(parts, string(runes))
+	}
+	return parts
+}
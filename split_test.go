@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitLargeMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		content string
+		want    []string
+	}{
+		{"未超过上限", splitModeSplit, "short", []string{"short"}},
+		{"split 拆成多条消息", splitModeSplit, "aaaaaaaaaabbbbbbbbbbcc", []string{"[1/3] aaaaaaaaaa", "[2/3] bbbbbbbbbb", "[3/3] cc"}},
+		{"split 优先在换行处切分", splitModeSplit, "aaaaaaa\nbbbbbbbbbb", []string{"[1/2] aaaaaaa\n", "[2/2] bbbbbbbbbb"}},
+		{"按字符而非字节计数", splitModeSplit, strings.Repeat("中", 15), []string{"[1/2] " + strings.Repeat("中", 10), "[2/2] " + strings.Repeat("中", 5)}},
+		{"truncate 截断并附加提示", splitModeTruncate, "aaaaaaaaaabbbbbbbbbbcc", []string{"aaaaaaaaaa" + truncatedNotice}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.SplitLargeMessages = tt.mode
+				c.MaxMessageChars = 10
+			})
+			var got []string
+			for _, msg := range splitLargeMessages([]ChatMessage{{Role: "user", Content: tt.content}}) {
+				if msg.Role != "user" {
+					t.Errorf("role = %q, want user", msg.Role)
+				}
+				got = append(got, messageText(msg))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitLargeMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitLargeMessagesRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		want string
+	}{
+		{"默认不处理", "", "user:aaaaaaaaaabbbbb"},
+		{"SPLIT_LARGE_MESSAGES=split", splitModeSplit, "user:[1/2] aaaaaaaaaa;\r\nuser:[2/2] bbbbb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.SplitLargeMessages = tt.mode
+				c.MaxMessageChars = 10
+				c.DevMode = true
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &scriptedUpstream{})
+			w := postCompletionWithHeaders(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"aaaaaaaaaabbbbb"}]}`,
+				map[string]string{"X-DDG-Include-Prompt": "true"})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var resp map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的响应: %v", err)
+			}
+			if got := resp["x_debug_prompt"]; got != tt.want {
+				t.Errorf("x_debug_prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
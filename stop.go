@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// errStopRegexMatched 用于在 STOP_REGEX 命中后提前结束读取上游
+var errStopRegexMatched = errors.New("stop regex matched")
+
+// stopRegex 为 STOP_REGEX 编译后的全局停止规则，未配置时为 nil
+var stopRegex *regexp.Regexp
+
+// stopRegexFilter 在尚未输出的尾部中查找 re 的首个匹配，命中后截断并丢弃之后的全部内容。
+// 尾部至少保留 holdback 字节暂不输出，使跨 chunk 的匹配也能在输出前被截断；
+// 每次只扫描保留的尾部与新内容，长时间的流式输出不会反复扫描全文
+type stopRegexFilter struct {
+	re       *regexp.Regexp
+	holdback int
+	pending  string
+	stopped  bool
+}
+
+func newStopRegexFilter(re *regexp.Regexp) *stopRegexFilter {
+	holdback, ok := maxMatchLen(re)
+	if !ok {
+		holdback = config.StopRegexHoldback
+	}
+	return &stopRegexFilter{re: re, holdback: holdback}
+}
+
+func (f *stopRegexFilter) Push(text string) string {
+	if f.stopped {
+		return ""
+	}
+	f.pending += text
+
+	if loc := f.re.FindStringIndex(f.pending); loc != nil {
+		f.stopped = true
+		out := f.pending[:loc[0]]
+		f.pending = ""
+		return out
+	}
+
+	release := len(f.pending) - f.holdback
+	for release > 0 && !utf8.RuneStart(f.pending[release]) {
+		release--
+	}
+	if release <= 0 {
+		return ""
+	}
+	out := f.pending[:release]
+	f.pending = f.pending[release:]
+	return out
+}
+
+func (f *stopRegexFilter) Flush() string {
+	if f.stopped {
+		return ""
+	}
+	out := f.pending
+	f.pending = ""
+	return out
+}
+
+// maxMatchLen 返回 re 一次匹配最多占用的字节数，包含 *、+ 或无上限重复时返回 false
+func maxMatchLen(re *regexp.Regexp) (int, bool) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return 0, false
+	}
+	return syntaxMaxLen(parsed.Simplify())
+}
+
+func syntaxMaxLen(re *syntax.Regexp) (int, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return 0, true
+	case syntax.OpLiteral:
+		n := 0
+		for _, r := range re.Rune {
+			// 忽略大小写时可能匹配到更长的编码，如 k 与 K（U+212A）
+			if re.Flags&syntax.FoldCase != 0 {
+				n += utf8.UTFMax
+			} else {
+				n += utf8.RuneLen(r)
+			}
+		}
+		return n, true
+	case syntax.OpCharClass, syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return utf8.UTFMax, true
+	case syntax.OpCapture, syntax.OpQuest:
+		return syntaxMaxLen(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Max < 0 {
+			return 0, false
+		}
+		n, ok := syntaxMaxLen(re.Sub[0])
+		return n * re.Max, ok
+	case syntax.OpConcat, syntax.OpAlternate:
+		total := 0
+		for _, sub := range re.Sub {
+			n, ok := syntaxMaxLen(sub)
+			if !ok {
+				return 0, false
+			}
+			if re.Op == syntax.OpConcat {
+				total += n
+			} else {
+				total = max(total, n)
+			}
+		}
+		return total, true
+	}
+	return 0, false
+}
+
+// appendStopFilter 在过滤链末尾追加停止规则，re 为 nil 时原样返回
+func appendStopFilter(filters []streamFilter, re *regexp.Regexp) ([]streamFilter, *stopRegexFilter) {
+	if re == nil {
+		return filters, nil
+	}
+	stop := newStopRegexFilter(re)
+	return append(filters, stop), stop
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestStopRegexFilter(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		name        string
+		pattern     string
+		chunks      []string
+		want        string
+		wantStopped bool
+	}{
+		{"同一 chunk 内命中", `STOP`, []string{"hello STOP world"}, "hello ", true},
+		{"匹配跨越多个 chunk", `STOP`, []string{"hello ST", "O", "P world"}, "hello ", true},
+		{"超过 64 字节的匹配跨越 chunk", `BEGIN` + long + `END`, []string{"ok BEGIN" + long[:50], long[50:] + "END tail"}, "ok ", true},
+		{"无上限的匹配使用 STOP_REGEX_HOLDBACK", `<end[a-z]*>`, []string{"ok <en", "dxx> tail"}, "ok ", true},
+		{"未命中时全部输出", `STOP`, []string{"hello ", "world"}, "hello world", false},
+		{"不拆开多字节字符", `结束`, []string{"中文内容", "结", "束后"}, "中文内容", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.StopRegexHoldback = 256 })
+			filter := newStopRegexFilter(regexp.MustCompile(tt.pattern))
+			var got strings.Builder
+			for _, chunk := range tt.chunks {
+				out := filter.Push(chunk)
+				if strings.Contains(out, "BEGIN") || strings.Contains(out, "<en") {
+					t.Errorf("停止序列的一部分在命中前被输出: %q", out)
+				}
+				got.WriteString(out)
+			}
+			got.WriteString(filter.Flush())
+			if got.String() != tt.want || filter.stopped != tt.wantStopped {
+				t.Errorf("got %q, stopped=%v; want %q, %v", got.String(), filter.stopped, tt.want, tt.wantStopped)
+			}
+		})
+	}
+}
+
+func TestStopRegexFilterBoundedScan(t *testing.T) {
+	filter := newStopRegexFilter(regexp.MustCompile(`STOP`))
+	for i := 0; i < 10000; i++ {
+		filter.Push("some streamed text ")
+		if len(filter.pending) > filter.holdback+len("some streamed text ") {
+			t.Fatalf("保留的尾部增长到 %d 字节", len(filter.pending))
+		}
+	}
+}
+
+func TestMaxMatchLen(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    int
+		ok      bool
+	}{
+		{`STOP`, 4, true},
+		{`(?i)stop`, 16, true},
+		{`a|bcd`, 3, true},
+		{`a{2,5}`, 5, true},
+		{`\d`, 4, true},
+		{`end.*`, 0, false},
+		{`a+`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, ok := maxMatchLen(regexp.MustCompile(tt.pattern))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("maxMatchLen(%s) = %d, %v; want %d, %v", tt.pattern, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// testPrompts 为 TEST_MODE 下的固定回复，键为最后一条 user 消息的完整文本
+var testPrompts map[string]string
+
+// loadTestPrompts 从 JSON 对象文件加载 "提示词": "回复" 映射
+func loadTestPrompts(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var prompts map[string]string
+	if err := json.Unmarshal(data, &prompts); err != nil {
+		return err
+	}
+	testPrompts = prompts
+	return nil
+}
+
+// cannedResponse 在 TEST_MODE 下查找与最后一条 user 消息完全一致的固定回复
+func cannedResponse(messages []ChatMessage) (string, bool) {
+	if !config.TestMode || len(testPrompts) == 0 {
+		return "", false
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			response, ok := testPrompts[messageText(messages[i])]
+			return response, ok
+		}
+	}
+	return "", false
+}
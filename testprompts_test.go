@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCannedResponses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.json")
+	if err := os.WriteFile(path, []byte(`{"magic prompt": "canned answer"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saved := testPrompts
+	t.Cleanup(func() { testPrompts = saved })
+	if err := loadTestPrompts(path); err != nil {
+		t.Fatalf("loadTestPrompts: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		testMode bool
+		prompt   string
+		want     string
+		wantChat int32
+	}{
+		{"默认请求上游", false, "magic prompt", "ok", 1},
+		{"TEST_MODE 命中时返回固定回复", true, "magic prompt", "canned answer", 0},
+		{"TEST_MODE 未命中时请求上游", true, "other prompt", "ok", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.TestMode = tt.testMode
+				c.ResponseCacheTTL = 0
+			})
+			upstream := &scriptedUpstream{}
+			withUpstream(t, upstream)
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"`+tt.prompt+`"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 {
+				t.Fatalf("无效的响应: %s", w.Body.String())
+			}
+			if got := resp.Choices[0].Message.Content; got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if got := upstream.chatCalls.Load(); got != tt.wantChat {
+				t.Errorf("对话请求 %d 次, want %d", got, tt.wantChat)
+			}
+		})
+	}
+}
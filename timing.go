@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTiming 记录一次对话请求的关键时间点，用于返回耗时相关的响应头
+type requestTiming struct {
+	start time.Time
+	// 最后一次对话请求的开始时间，不含获取 token 的耗时
+	chatStart time.Time
+}
+
+// setDiagHeader 设置诊断用响应头（X-Request-ID、X-Upstream-Model、X-Retry-Count、X-Cache、
+// 耗时相关头），关闭 EXPOSE_DIAG_HEADERS 时整组不输出
+func setDiagHeader(c *gin.Context, name, value string) {
+	if config.ExposeDiagHeaders {
+		c.Header(name, value)
+	}
+}
+
+// setHeaders 设置 X-Upstream-Latency-Ms 与 X-Total-Latency-Ms；
+// 流式响应在首个数据块写出前调用，此时总耗时即首字耗时，额外设置 X-TTFT-Ms
+func (t *requestTiming) setHeaders(c *gin.Context, stream bool) {
+	now := time.Now()
+	if !t.chatStart.IsZero() {
+		setDiagHeader(c, "X-Upstream-Latency-Ms", strconv.FormatInt(now.Sub(t.chatStart).Milliseconds(), 10))
+	}
+	total := strconv.FormatInt(now.Sub(t.start).Milliseconds(), 10)
+	setDiagHeader(c, "X-Total-Latency-Ms", total)
+	if stream {
+		setDiagHeader(c, "X-TTFT-Ms", total)
+	}
+}
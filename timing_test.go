@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLatencyHeaders(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	tests := []struct {
+		name     string
+		stream   bool
+		expose   bool
+		wantTTFT bool
+	}{
+		{"非流式", false, true, false},
+		{"流式返回首字耗时", true, true, true},
+		{"关闭诊断响应头", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ExposeDiagHeaders = tt.expose
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/duckchat/v1/status" {
+					w.Header().Set("x-vqd-4", testVQD)
+					return
+				}
+				time.Sleep(delay)
+				w.Write([]byte("data: {\"message\":\"ok\"}\n\ndata: [DONE]\n\n"))
+			}))
+			body := `{"model":"gpt-4o-mini","stream":` + strconv.FormatBool(tt.stream) + `,"messages":[{"role":"user","content":"hi"}]}`
+			w := postCompletion(t, handleCompletion, body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			header := func(name string) (int64, bool) {
+				value := w.Header().Get(name)
+				if value == "" {
+					return 0, false
+				}
+				ms, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					t.Fatalf("%s = %q 不是整数", name, value)
+				}
+				return ms, true
+			}
+			upstream, hasUpstream := header("X-Upstream-Latency-Ms")
+			total, hasTotal := header("X-Total-Latency-Ms")
+			_, hasTTFT := header("X-TTFT-Ms")
+			if hasUpstream != tt.expose || hasTotal != tt.expose || hasTTFT != tt.wantTTFT {
+				t.Fatalf("headers = %v, want upstream/total %v, ttft %v", w.Header(), tt.expose, tt.wantTTFT)
+			}
+			if tt.expose && (upstream < delay.Milliseconds() || total < upstream) {
+				t.Errorf("X-Upstream-Latency-Ms = %d, X-Total-Latency-Ms = %d, want >= %d and total >= upstream", upstream, total, delay.Milliseconds())
+			}
+		})
+	}
+}
+
+func TestExposeDiagHeaders(t *testing.T) {
+	diagHeaders := []string{"X-Request-ID", "X-Upstream-Model", "X-Retry-Count", "X-Cache", "X-Total-Latency-Ms"}
+	tests := []struct {
+		name   string
+		expose bool
+	}{
+		{"默认输出诊断响应头", true},
+		{"EXPOSE_DIAG_HEADERS=false 时全部隐藏", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ExposeDiagHeaders = tt.expose
+				c.ResponseCacheTTL = time.Minute
+			})
+			t.Cleanup(func() { responseCache.flush() })
+			withUpstream(t, &scriptedUpstream{})
+
+			r := gin.New()
+			r.Use(requestIDMiddleware())
+			r.POST("/v1/chat/completions", handleCompletion)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"diag"}]}`))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			for _, name := range diagHeaders {
+				if got := w.Header().Get(name) != ""; got != tt.expose {
+					t.Errorf("%s 存在 = %v, want %v", name, got, tt.expose)
+				}
+			}
+		})
+	}
+}
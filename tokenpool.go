@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type pooledToken struct {
+	value   string
+	fetched time.Time
+}
+
+// tokenPool 在后台维持若干个预先获取的 token，每个请求独占租用一个，
+// 突发并发时请求分散到不同的 token 上；租出后异步补充
+type tokenPool struct {
+	tokens chan pooledToken
+	refill chan struct{}
+}
+
+// upstreamTokenPool 仅在 TOKEN_POOL_SIZE > 0 时创建
+var upstreamTokenPool *tokenPool
+
+func startTokenPool(size int) *tokenPool {
+	pool := &tokenPool{
+		tokens: make(chan pooledToken, size),
+		refill: make(chan struct{}, size),
+	}
+	for i := 0; i < size; i++ {
+		pool.refill <- struct{}{}
+	}
+	go pool.run()
+	return pool
+}
+
+const (
+	// minTokenPoolBackoff、maxTokenPoolBackoff 限定补充失败后的等待时间，
+	// 避免 RETRY_DELAY 为 0 时对上游空转重试
+	minTokenPoolBackoff = time.Second
+	maxTokenPoolBackoff = time.Minute
+)
+
+// tokenPoolSleep 便于测试替换
+var tokenPoolSleep = time.Sleep
+
+// tokenPoolBackoff 返回第 failures 次连续失败后的等待时间：
+// 以 max(RETRY_DELAY, 1s) 为起点逐次翻倍，最多 1 分钟
+func tokenPoolBackoff(failures int) time.Duration {
+	delay := max(config.RetryDelay, minTokenPoolBackoff)
+	for i := 1; i < failures && delay < maxTokenPoolBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxTokenPoolBackoff)
+}
+
+// run 逐个补充 token，获取失败时按 tokenPoolBackoff 退避后重试同一个空位
+func (p *tokenPool) run() {
+	for range p.refill {
+		for failures := 1; ; failures++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			token, err := requestToken(ctx)
+			cancel()
+			if err == nil {
+				p.tokens <- pooledToken{value: token, fetched: time.Now()}
+				break
+			}
+			delay := tokenPoolBackoff(failures)
+			log.Printf("补充 token 池失败, %v 后重试: %v", delay, err)
+			tokenPoolSleep(delay)
+		}
+	}
+}
+
+// lease 取出一个 token 并触发补充，池为空时返回 false；
+// 配置了 TOKEN_CACHE_TTL 时丢弃超过有效期的 token
+func (p *tokenPool) lease() (string, bool) {
+	for {
+		select {
+		case token := <-p.tokens:
+			p.refill <- struct{}{}
+			if config.TokenCacheTTL > 0 && time.Since(token.fetched) > config.TokenCacheTTL {
+				continue
+			}
+			return token.value, true
+		default:
+			return "", false
+		}
+	}
+}
+
+// tokenFetchSlots 限制同时进行的 token 获取数，MAX_CONCURRENT_TOKEN_FETCHES 为 0 时为 nil，不做限制
+var tokenFetchSlots chan struct{}
+
+// acquireTokenFetch 占用一个 token 获取名额，名额已满时等待其他获取结束；返回的函数用于释放名额
+func acquireTokenFetch(ctx context.Context) (func(), error) {
+	if tokenFetchSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case tokenFetchSlots <- struct{}{}:
+	default:
+		attemptLoggerFrom(ctx).Printf("同时获取 token 的请求已达上限 %d, 等待", cap(tokenFetchSlots))
+		select {
+		case tokenFetchSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-tokenFetchSlots }, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenPoolBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryDelay time.Duration
+		failures   int
+		want       time.Duration
+	}{
+		{"RETRY_DELAY 为 0 时不低于 1s", 0, 1, time.Second},
+		{"RETRY_DELAY 为 0 时逐次翻倍", 0, 3, 4 * time.Second},
+		{"默认 RETRY_DELAY", 5 * time.Second, 1, 5 * time.Second},
+		{"默认 RETRY_DELAY 第二次失败", 5 * time.Second, 2, 10 * time.Second},
+		{"不超过上限", 5 * time.Second, 10, time.Minute},
+		{"RETRY_DELAY 超过上限", 2 * time.Minute, 1, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.RetryDelay = tt.retryDelay })
+			if got := tokenPoolBackoff(tt.failures); got != tt.want {
+				t.Errorf("tokenPoolBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenPoolRetryBackoff(t *testing.T) {
+	withConfig(t, func(c *Config) { c.RetryDelay = 0 })
+	withUpstream(t, &scriptedUpstream{status: []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests}})
+
+	var slept []time.Duration
+	saved := tokenPoolSleep
+	tokenPoolSleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() { tokenPoolSleep = saved })
+
+	pool := startTokenPool(1)
+	t.Cleanup(func() { close(pool.refill) })
+	select {
+	case token := <-pool.tokens:
+		if token.value != testVQD {
+			t.Errorf("token = %q, want %q", token.value, testVQD)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("token 池未能补充")
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(slept) != len(want) {
+		t.Fatalf("退避 = %v, want %v", slept, want)
+	}
+	for i := range want {
+		if slept[i] != want[i] {
+			t.Errorf("退避 = %v, want %v", slept, want)
+			break
+		}
+	}
+}
+
+func TestMaxConcurrentTokenFetches(t *testing.T) {
+	const callers = 8
+	tests := []struct {
+		name    string
+		limit   int
+		wantMax int32
+	}{
+		{"默认不限制", 0, callers},
+		{"MAX_CONCURRENT_TOKEN_FETCHES 限制并发", 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := tokenFetchSlots
+			tokenFetchSlots = nil
+			if tt.limit > 0 {
+				tokenFetchSlots = make(chan struct{}, tt.limit)
+			}
+			t.Cleanup(func() { tokenFetchSlots = saved })
+
+			var inFlight, peak atomic.Int32
+			upstream := &scriptedUpstream{}
+			withUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/duckchat/v1/status" {
+					n := inFlight.Add(1)
+					for {
+						p := peak.Load()
+						if n <= p || peak.CompareAndSwap(p, n) {
+							break
+						}
+					}
+					time.Sleep(100 * time.Millisecond)
+					inFlight.Add(-1)
+				}
+				upstream.ServeHTTP(w, r)
+			}))
+
+			var wg sync.WaitGroup
+			errs := make(chan error, callers)
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := requestToken(context.Background()); err != nil {
+						errs <- err
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Errorf("requestToken: %v", err)
+			}
+			if got := peak.Load(); got != tt.wantMax {
+				t.Errorf("同时进行的 token 请求最多 %d 个, want %d", got, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "unicode"
+
+// estimateTokens 粗略估算文本的 token 数：中日韩字符按每字 1 个 token，
+// 其余字符按每 4 个字符 1 个 token 计算
+func estimateTokens(text string) int {
+	var counter tokenCounter
+	counter.add(text)
+	return counter.tokens()
+}
+
+// tokenCounter 累计字符数以增量估算 token，流式输出时每个增量只需统计一次
+type tokenCounter struct {
+	cjk, other int
+}
+
+func (tc *tokenCounter) add(text string) {
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			tc.cjk++
+		} else {
+			tc.other++
+		}
+	}
+}
+
+func (tc *tokenCounter) tokens() int {
+	return tc.cjk + (tc.other+3)/4
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"你好", 2},
+		{"你好abcd", 3},
+		{"こんにちは", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := estimateTokens(tt.text); got != tt.want {
+				t.Errorf("estimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCounterIncremental(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []string
+	}{
+		{"英文", []string{"Hel", "lo, ", "wor", "ld"}},
+		{"中文", []string{"你好", "，世界"}},
+		{"混合", []string{"a", "中", "bc", "文d", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var counter tokenCounter
+			for _, delta := range tt.deltas {
+				counter.add(delta)
+			}
+			if got, want := counter.tokens(), estimateTokens(strings.Join(tt.deltas, "")); got != want {
+				t.Errorf("tokens() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamLiveUsage(t *testing.T) {
+	withConfig(t, func(c *Config) { c.StreamLiveUsage = true })
+	chunks, _ := runStream(t, messageSource("abcd", "efgh", "中文"), nil)
+
+	want := []int{1, 2, 4}
+	var got []int
+	for _, chunk := range chunks {
+		if content, _ := chunkContent(chunk); content == "" {
+			continue
+		}
+		usage, ok := chunk["x_usage"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("数据块缺少 x_usage: %v", chunk)
+		}
+		got = append(got, int(usage["completion_tokens"].(float64)))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("completion_tokens = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("completion_tokens = %v, want %v", got, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	upstreamTransport     *http.Transport
+	upstreamTransportOnce sync.Once
+)
+
+// getUpstreamTransport 返回所有上游请求共享的 Transport，复用连接池
+func getUpstreamTransport() *http.Transport {
+	upstreamTransportOnce.Do(func() {
+		upstreamTransport = newUpstreamTransport()
+	})
+	return upstreamTransport
+}
+
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	var defaultProxy *url.URL
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			log.Printf("代理URL解析失败: %v", err)
+		} else {
+			defaultProxy = proxyURL
+		}
+	}
+	// 请求上下文中指定的代理优先，其次为 PROXY_URL
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if proxyURL, ok := req.Context().Value(proxyContextKey{}).(*url.URL); ok {
+			return proxyURL, nil
+		}
+		return defaultProxy, nil
+	}
+
+	transport.MaxIdleConns = config.MaxIdleConns
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.TLSClientConfig = newTLSConfig()
+	return transport
+}
+
+type proxyContextKey struct{}
+
+// withProxy 指定该上下文中的上游请求使用的代理
+func withProxy(ctx context.Context, proxyURL *url.URL) context.Context {
+	return context.WithValue(ctx, proxyContextKey{}, proxyURL)
+}
+
+// proxyRotation 轮询 PROXY_URLS 中的代理
+type proxyRotation struct {
+	urls []*url.URL
+	next atomic.Uint64
+}
+
+var upstreamProxies = &proxyRotation{}
+
+func newProxyRotation(raw []string) *proxyRotation {
+	rotation := &proxyRotation{}
+	for _, item := range raw {
+		proxyURL, err := url.Parse(item)
+		if err != nil {
+			log.Printf("PROXY_URLS 中的代理解析失败, 已忽略: %v", err)
+			continue
+		}
+		rotation.urls = append(rotation.urls, proxyURL)
+	}
+	return rotation
+}
+
+// pick 按轮询返回下一个代理，跳过 exclude（仅剩一个代理时除外）；未配置 PROXY_URLS 时返回 nil
+func (r *proxyRotation) pick(exclude *url.URL) *url.URL {
+	if len(r.urls) == 0 {
+		return nil
+	}
+	for range r.urls {
+		proxyURL := r.urls[(r.next.Add(1)-1)%uint64(len(r.urls))]
+		if exclude == nil || proxyURL.String() != exclude.String() {
+			return proxyURL
+		}
+	}
+	return r.urls[0]
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// newTLSConfig 根据配置生成上游连接的 TLS 参数，无法识别的项记录日志后忽略
+func newTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if version, ok := tlsVersions[config.TLSMinVersion]; ok {
+		tlsConfig.MinVersion = version
+	} else {
+		log.Printf("UPSTREAM_TLS_MIN_VERSION 无效: %s, 使用 1.2", config.TLSMinVersion)
+	}
+
+	if len(config.TLSCiphers) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range config.TLSCiphers {
+			if id, ok := suites[name]; ok {
+				tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+			} else {
+				log.Printf("未知的 TLS 密码套件: %s", name)
+			}
+		}
+	}
+
+	for _, name := range config.TLSCurves {
+		if id, ok := tlsCurves[strings.ToUpper(name)]; ok {
+			tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, id)
+		} else {
+			log.Printf("未知的 TLS 曲线: %s", name)
+		}
+	}
+
+	return tlsConfig
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamTransport(t *testing.T) {
+	tests := []struct {
+		name        string
+		update      func(c *Config)
+		wantVersion uint16
+		wantCiphers []uint16
+		wantCurves  []tls.CurveID
+	}{
+		{
+			name:        "默认 TLS 1.2",
+			update:      func(c *Config) { c.TLSMinVersion = "1.2" },
+			wantVersion: tls.VersionTLS12,
+		},
+		{
+			name:        "TLS 1.3",
+			update:      func(c *Config) { c.TLSMinVersion = "1.3" },
+			wantVersion: tls.VersionTLS13,
+		},
+		{
+			name:        "无效版本回退到 1.2",
+			update:      func(c *Config) { c.TLSMinVersion = "9" },
+			wantVersion: tls.VersionTLS12,
+		},
+		{
+			name: "密码套件与曲线，忽略未知项",
+			update: func(c *Config) {
+				c.TLSMinVersion = "1.2"
+				c.TLSCiphers = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "UNKNOWN"}
+				c.TLSCurves = []string{"x25519", "P256", "P999"}
+			},
+			wantVersion: tls.VersionTLS12,
+			wantCiphers: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			wantCurves:  []tls.CurveID{tls.X25519, tls.CurveP256},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.TLSCiphers, c.TLSCurves = nil, nil
+				tt.update(c)
+			})
+			tlsConfig := newUpstreamTransport().TLSClientConfig
+			if tlsConfig.MinVersion != tt.wantVersion {
+				t.Errorf("MinVersion = %x, want %x", tlsConfig.MinVersion, tt.wantVersion)
+			}
+			if !slices.Equal(tlsConfig.CipherSuites, tt.wantCiphers) {
+				t.Errorf("CipherSuites = %v, want %v", tlsConfig.CipherSuites, tt.wantCiphers)
+			}
+			if !slices.Equal(tlsConfig.CurvePreferences, tt.wantCurves) {
+				t.Errorf("CurvePreferences = %v, want %v", tlsConfig.CurvePreferences, tt.wantCurves)
+			}
+		})
+	}
+}
+
+func TestNewUpstreamTransportConnectionPool(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxIdle, perHost int
+		maxConns         int
+		idleTimeout      time.Duration
+	}{
+		{"默认值", 100, 0, 0, 90 * time.Second},
+		{"自定义连接池", 7, 3, 5, 42 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MaxIdleConns = tt.maxIdle
+				c.MaxIdleConnsPerHost = tt.perHost
+				c.MaxConnsPerHost = tt.maxConns
+				c.IdleConnTimeout = tt.idleTimeout
+			})
+			transport := newUpstreamTransport()
+			if transport.MaxIdleConns != tt.maxIdle || transport.MaxIdleConnsPerHost != tt.perHost || transport.MaxConnsPerHost != tt.maxConns {
+				t.Errorf("连接池参数 = %d/%d/%d, want %d/%d/%d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.MaxConnsPerHost, tt.maxIdle, tt.perHost, tt.maxConns)
+			}
+			if transport.IdleConnTimeout != tt.idleTimeout {
+				t.Errorf("IdleConnTimeout = %v, want %v", transport.IdleConnTimeout, tt.idleTimeout)
+			}
+		})
+	}
+}
+
+func TestProxyRotationSkipsBlocked(t *testing.T) {
+	tests := []struct {
+		name string
+		chat []int
+		want []string
+	}{
+		{"其他错误不避开代理", []int{http.StatusBadGateway}, []string{"http://proxy-a:8080", "http://proxy-a:8080"}},
+		{"418 后的重试避开该代理", []int{http.StatusTeapot}, []string{"http://proxy-a:8080", "http://proxy-b:8080"}},
+		{"429 后的重试避开该代理", []int{http.StatusTooManyRequests}, []string{"http://proxy-a:8080", "http://proxy-b:8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MaxRetryCount = 3
+				c.RetryDelay = 0
+				c.ResponseCacheTTL = 0
+				c.FallbackModels = nil
+				c.AdaptiveBlocking = false
+			})
+			savedProxies := upstreamProxies
+			upstreamProxies = newProxyRotation([]string{"http://proxy-a:8080", "http://proxy-b:8080"})
+			t.Cleanup(func() { upstreamProxies = savedProxies })
+
+			withUpstream(t, &scriptedUpstream{chat: tt.chat})
+			// 记录每次对话请求所选的代理，实际仍直连测试服务器；
+			// 第一次请求后模拟一个并发请求占用 proxy-b，使轮询的下一个代理回到 proxy-a
+			var mu sync.Mutex
+			var used []string
+			upstreamTransport.Proxy = func(req *http.Request) (*url.URL, error) {
+				if proxyURL, ok := req.Context().Value(proxyContextKey{}).(*url.URL); ok && req.URL.Path == "/duckchat/v1/chat" {
+					mu.Lock()
+					used = append(used, proxyURL.String())
+					if len(used) == 1 {
+						upstreamProxies.next.Add(1)
+					}
+					mu.Unlock()
+				}
+				return nil, nil
+			}
+
+			w := postCompletion(t, handleCompletion, `{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+			if !reflect.DeepEqual(used, tt.want) {
+				t.Errorf("使用的代理 = %q, want %q", used, tt.want)
+			}
+		})
+	}
+}
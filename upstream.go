@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// defaultBodyTemplate 与 DuckDuckGo 当前接受的请求体一致
+const defaultBodyTemplate = `{"model":"{{model}}","messages":"{{messages}}"}`
+
+// loadBodyTemplate 解析上游请求体模板，为空或无效时使用默认模板
+func loadBodyTemplate(raw string) map[string]interface{} {
+	var template map[string]interface{}
+	if raw != "" {
+		err := json.Unmarshal([]byte(raw), &template)
+		if err == nil {
+			return template
+		}
+		log.Printf("UPSTREAM_BODY_TEMPLATE 解析失败, 使用默认模板: %v", err)
+	}
+	json.Unmarshal([]byte(defaultBodyTemplate), &template)
+	return template
+}
+
+// buildUpstreamBody 将拼接后的提示词填入请求体模板，便于上游格式变化时无需重新编译
+func buildUpstreamBody(model, content string) map[string]interface{} {
+	values := map[string]interface{}{
+		"{{model}}":   model,
+		"{{content}}": content,
+		"{{messages}}": []map[string]interface{}{
+			{
+				"role":    "user",
+				"content": content,
+			},
+		},
+	}
+
+	body := fillTemplate(config.UpstreamBodyTemplate, values).(map[string]interface{})
+	// 模板中遗漏的必需字段按默认格式补齐
+	if _, ok := body["model"]; !ok {
+		body["model"] = model
+	}
+	if _, ok := body["messages"]; !ok {
+		body["messages"] = values["{{messages}}"]
+	}
+	return body
+}
+
+// fillTemplate 递归复制模板并替换整值为占位符的字符串
+func fillTemplate(node interface{}, values map[string]interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		filled := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			filled[key] = fillTemplate(child, values)
+		}
+		return filled
+	case []interface{}:
+		filled := make([]interface{}, len(v))
+		for i, child := range v {
+			filled[i] = fillTemplate(child, values)
+		}
+		return filled
+	case string:
+		if value, ok := values[v]; ok {
+			return value
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// buildUpstreamRequest 构建一次对话请求：伪装请求头、token 以及每个请求单独计算的动态头都在这里设置，
+// 上游将来要求 nonce、时间戳或签名时只需修改此处
+func buildUpstreamRequest(ctx context.Context, body []byte, token string, opts chatOptions) (*http.Request, error) {
+	upstreamReq, err := http.NewRequestWithContext(ctx, "POST", "https://duckduckgo.com/duckchat/v1/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+
+	for k, v := range config.FakeHeaders {
+		upstreamReq.Header.Set(k, v)
+	}
+	if opts.AcceptLanguage != "" {
+		upstreamReq.Header.Set("Accept-Language", opts.AcceptLanguage)
+	}
+	upstreamReq.Header.Set("x-vqd-4", token)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	return upstreamReq, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestBuildUpstreamRequest(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.FakeHeaders = map[string]string{"User-Agent": "test-agent", "Accept-Language": "zh-CN"}
+	})
+	tests := []struct {
+		name     string
+		opts     chatOptions
+		wantLang string
+	}{
+		{"使用伪装请求头", chatOptions{}, "zh-CN"},
+		{"按请求覆盖 Accept-Language", chatOptions{AcceptLanguage: "en-US"}, "en-US"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := buildUpstreamRequest(context.Background(), []byte(`{"a":1}`), testVQD, tt.opts)
+			if err != nil {
+				t.Fatalf("buildUpstreamRequest: %v", err)
+			}
+			if req.Method != http.MethodPost || req.URL.String() != "https://duckduckgo.com/duckchat/v1/chat" {
+				t.Errorf("请求 = %s %s", req.Method, req.URL)
+			}
+			want := map[string]string{
+				"x-vqd-4":         testVQD,
+				"Content-Type":    "application/json",
+				"User-Agent":      "test-agent",
+				"Accept-Language": tt.wantLang,
+			}
+			for name, value := range want {
+				if got := req.Header.Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+			if body, _ := io.ReadAll(req.Body); string(body) != `{"a":1}` {
+				t.Errorf("body = %s", body)
+			}
+		})
+	}
+}
+
+func TestBuildUpstreamBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"默认模板", "", `{"messages":[{"content":"hi","role":"user"}],"model":"gpt-4o-mini"}`},
+		{"自定义模板补齐必需字段", `{"prompt":"{{content}}","extra":[1,"{{model}}"]}`,
+			`{"extra":[1,"gpt-4o-mini"],"messages":[{"content":"hi","role":"user"}],"model":"gpt-4o-mini","prompt":"hi"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.UpstreamBodyTemplate = loadBodyTemplate(tt.template) })
+			data, _ := json.Marshal(buildUpstreamBody("gpt-4o-mini", "hi"))
+			if string(data) != tt.want {
+				t.Errorf("body = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
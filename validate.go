@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var allowedRoles = map[string]bool{
+	"system":    true,
+	"developer": true,
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+	"function":  true,
+}
+
+// validateChatSchema 按精简的 OpenAI chat 规范检查请求体，返回所有违规项
+func validateChatSchema(raw []byte) []string {
+	var body map[string]interface{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return []string{fmt.Sprintf("请求体必须是 JSON 对象: %v", err)}
+	}
+
+	var violations []string
+	addf := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+
+	if v, ok := body["model"]; ok {
+		if _, isString := v.(string); !isString {
+			addf("model 必须是字符串")
+		}
+	}
+	if v, ok := body["stream"]; ok {
+		if _, isBool := v.(bool); !isBool {
+			addf("stream 必须是布尔值")
+		}
+	}
+	for _, field := range []string{"temperature", "top_p", "presence_penalty", "frequency_penalty"} {
+		if v, ok := body[field]; ok {
+			if _, isNumber := v.(float64); !isNumber {
+				addf("%s 必须是数字", field)
+			}
+		}
+	}
+	if v, ok := body["max_tokens"]; ok {
+		if n, isNumber := v.(float64); !isNumber || n != math.Trunc(n) {
+			addf("max_tokens 必须是整数")
+		}
+	}
+
+	messages, ok := body["messages"].([]interface{})
+	if !ok {
+		addf("messages 必须是数组")
+		return violations
+	}
+	if len(messages) == 0 {
+		addf("messages 不能为空")
+	}
+
+	for i, item := range messages {
+		msg, ok := item.(map[string]interface{})
+		if !ok {
+			addf("messages[%d] 必须是对象", i)
+			continue
+		}
+
+		role, isString := msg["role"].(string)
+		switch {
+		case msg["role"] == nil:
+			addf("messages[%d].role 不能为空", i)
+		case !isString:
+			addf("messages[%d].role 必须是字符串", i)
+		case !allowedRoles[role]:
+			addf("messages[%d].role 不支持: %s", i, role)
+		}
+
+		if name, ok := msg["name"]; ok {
+			if _, isString := name.(string); !isString {
+				addf("messages[%d].name 必须是字符串", i)
+			}
+		}
+
+		// 数字、布尔值会被转为字符串，单个内容对象按只有一个元素的数组处理
+		switch content := msg["content"].(type) {
+		case nil, string, float64, bool:
+		case []interface{}:
+			for j, part := range content {
+				validateContentPart(part, fmt.Sprintf("messages[%d].content[%d]", i, j), addf)
+			}
+		case map[string]interface{}:
+			validateContentPart(content, fmt.Sprintf("messages[%d].content", i), addf)
+		}
+	}
+
+	return violations
+}
+
+func validateContentPart(part interface{}, path string, addf func(format string, args ...interface{})) {
+	partMap, ok := part.(map[string]interface{})
+	if !ok {
+		addf("%s 必须是对象", path)
+		return
+	}
+
+	switch partMap["type"] {
+	case "text":
+		if _, ok := partMap["text"].(string); !ok {
+			addf("%s.text 必须是字符串", path)
+		}
+	case "image_url":
+		if _, ok := partMap["image_url"].(map[string]interface{}); !ok {
+			addf("%s.image_url 必须是对象", path)
+		}
+	case nil:
+		addf("%s.type 不能为空", path)
+	default:
+		addf("%s.type 不支持: %v", path, partMap["type"])
+	}
+}
+
+// violationParam 取违规描述开头的字段路径作为 param，描述不以字段开头时返回空字符串
+func violationParam(violation string) string {
+	path, _, _ := strings.Cut(violation, " ")
+	if path == "" || !(path[0] >= 'a' && path[0] <= 'z') {
+		return ""
+	}
+	return path
+}
+
+// validateSamplingRanges 按 OpenAI 的取值范围检查采样参数
+func validateSamplingRanges(req *ChatRequest) *paramError {
+	checkRange := func(param string, value *float64, lower, upper float64) *paramError {
+		if value != nil && (*value < lower || *value > upper) {
+			return &paramError{Param: param, Message: fmt.Sprintf("%s 必须在 %g 到 %g 之间", param, lower, upper)}
+		}
+		return nil
+	}
+	if err := checkRange("temperature", req.Temperature, 0, 2); err != nil {
+		return err
+	}
+	if err := checkRange("top_p", req.TopP, 0, 1); err != nil {
+		return err
+	}
+	if err := checkRange("presence_penalty", req.PresencePenalty, -2, 2); err != nil {
+		return err
+	}
+	if err := checkRange("frequency_penalty", req.FrequencyPenalty, -2, 2); err != nil {
+		return err
+	}
+	if req.MaxTokens != nil && *req.MaxTokens < 1 {
+		return &paramError{Param: "max_tokens", Message: "max_tokens 必须大于 0"}
+	}
+	return nil
+}
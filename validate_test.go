@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestValidateChatSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"合法请求", `{"model":"gpt-4o-mini","stream":false,"messages":[{"role":"user","content":"hi"}]}`, nil},
+		{"数组内容", `{"messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"x"}}]}]}`, nil},
+		{"非 JSON 对象", `[]`, []string{"请求体必须是 JSON 对象: json: cannot unmarshal array into Go value of type map[string]interface {}"}},
+		{"缺少 messages", `{"model":"gpt-4o-mini"}`, []string{"messages 必须是数组"}},
+		{"字段类型错误", `{"model":1,"stream":"yes","temperature":"1","max_tokens":1.5,"messages":[]}`, []string{
+			"model 必须是字符串", "stream 必须是布尔值", "temperature 必须是数字", "max_tokens 必须是整数", "messages 不能为空",
+		}},
+		{"消息违规", `{"messages":[1,{"content":"x"},{"role":"robot","name":2},{"role":"user","content":[{"text":"x"},{"type":"audio"}]}]}`, []string{
+			"messages[0] 必须是对象",
+			"messages[1].role 不能为空",
+			"messages[2].role 不支持: robot",
+			"messages[2].name 必须是字符串",
+			"messages[3].content[0].type 不能为空",
+			"messages[3].content[1].type 不支持: audio",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateChatSchema([]byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateChatSchema() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSchemaRequest(t *testing.T) {
+	const body = `{"model":"gpt-4o-mini","messages":[{"role":"robot","content":"hi"}]}`
+	tests := []struct {
+		name      string
+		validate  bool
+		want      int
+		wantParam string
+	}{
+		{"默认不校验", false, http.StatusOK, ""},
+		{"VALIDATE_SCHEMA 返回 400", true, http.StatusBadRequest, "messages[0].role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ValidateSchema = tt.validate
+				c.ResponseCacheTTL = 0
+			})
+			withUpstream(t, &scriptedUpstream{})
+			w := postCompletion(t, handleCompletion, body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.wantParam == "" {
+				return
+			}
+			var resp struct {
+				Error struct {
+					Param string `json:"param"`
+				} `json:"error"`
+				Violations []string `json:"violations"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("无效的错误响应: %v", err)
+			}
+			if resp.Error.Param != tt.wantParam || len(resp.Violations) != 1 {
+				t.Errorf("response = %+v, want param %q", resp, tt.wantParam)
+			}
+		})
+	}
+}